@@ -0,0 +1,106 @@
+package catalog
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// topDir returns the top-level directory of src which f is in, or "." for
+// the files directly in src.
+func topDir(f *file) string {
+	dir, _, ok := strings.Cut(f.srcPath(), string(filepath.Separator))
+	if !ok {
+		return "."
+	}
+	return dir
+}
+
+// allocate splits budget between directories of the given total sizes, in
+// proportion to them with --balance-dirs=size or equally with
+// --balance-dirs=equal. What a directory doesn't need of its share goes to
+// the others, so no space is left unused while some directory doesn't fit.
+func (r *runner) allocate(sizes map[string]int64, budget int64) map[string]int64 {
+	alloc := make(map[string]int64)
+	open := make([]string, 0, len(sizes))
+	for dir := range sizes {
+		open = append(open, dir)
+	}
+	slices.Sort(open)
+	for len(open) > 0 && budget > 0 {
+		var weight int64
+		for _, dir := range open {
+			if r.BalanceDirs == "size" {
+				weight += sizes[dir]
+			} else {
+				weight++
+			}
+		}
+		share := func(dir string) int64 {
+			if r.BalanceDirs == "size" {
+				// In floating point, as budget times size overflows for
+				// terabytes.
+				return int64(float64(budget) * float64(sizes[dir]) / float64(weight))
+			}
+			return budget / weight
+		}
+		var rest []string
+		var given int64
+		for _, dir := range open {
+			if sizes[dir] <= share(dir) {
+				alloc[dir] = sizes[dir]
+				given += sizes[dir]
+			} else {
+				rest = append(rest, dir)
+			}
+		}
+		if len(rest) == len(open) {
+			for _, dir := range rest {
+				alloc[dir] = share(dir)
+			}
+			break
+		}
+		budget -= given
+		open = rest
+	}
+	return alloc
+}
+
+// balanceDirs is mostRecent with --balance-dirs, selecting within each
+// top-level directory of src for its share of budget.
+func (r *runner) balanceDirs(files []*file, budget int64) (kept, skipped []*file, err error) {
+	groups := make(map[string][]*file)
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		dir := topDir(f)
+		groups[dir] = append(groups[dir], f)
+		sizes[dir] += r.allocated(f.size)
+	}
+	alloc := r.allocate(sizes, budget)
+	dirs := make([]string, 0, len(groups))
+	for dir := range groups {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	log.Printf("Balancing the budget of %s between %d directories by %s\n",
+		r.formatSize(budget), len(dirs), r.BalanceDirs)
+	for _, dir := range dirs {
+		k, s, err := r.mostRecent(groups[dir], alloc[dir])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		used := r.allocatedSize(k)
+		report("balance", fmt.Sprintf("%s: %s allocated, %s used by %d of %d files (%s)",
+			dir, r.formatSize(alloc[dir]), r.formatSize(used), len(k), len(groups[dir]), r.formatSize(sizes[dir])),
+			"dir", dir, "allocated", alloc[dir], "used", used, "kept", len(k), "files", len(groups[dir]), "size", sizes[dir])
+		kept = append(kept, k...)
+		skipped = append(skipped, s...)
+	}
+	// In the order of a selection over all of src, for placing and
+	// --report-skipped.
+	slices.SortFunc(kept, r.order)
+	slices.SortFunc(skipped, r.order)
+	return kept, skipped, nil
+}
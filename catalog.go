@@ -1,36 +1,54 @@
-// This tool takes the most recent files from src and copies that to dst.
-// $ time go run catalog.go --src=/tank/photos/ --dst=/media/keisuke/PHOTOS_A/
-package main
+// Package catalog takes the most recent files from src and copies them to dst,
+// as many as fit. The catalog command in cmd/catalog is its command line
+// interface; Run is the same for other programs.
+package catalog
 
 import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"slices"
-	"syscall"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
-var (
-	src = flag.String("src", "", "")
-	dst = flag.String("dst", "", "")
-)
+var binaryUnits = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// humanize formats n with binary units, e.g. "1.50 GiB".
+func humanize(n int64) string {
+	if -1024 < n && n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n) / 1024
+	i := 0
+	// Compare the rounded value so that we print "1.00 MiB" rather than
+	// "1024.00 KiB".
+	for ; i < len(binaryUnits)-1 && math.Abs(math.Round(v*100)/100) >= 1024; i++ {
+		v /= 1024
+	}
+	return fmt.Sprintf("%.2f %s", v, binaryUnits[i])
+}
 
-// stat returns the capacity of the storage corresponding to dir.
-func stat(dir string) (int64, error) {
-	var stat unix.Statfs_t
-	if err := unix.Statfs(dir, &stat); err != nil {
-		return 0, err
+// formatSize formats n for printing, honoring --raw-bytes.
+func (r *runner) formatSize(n int64) string {
+	if r.RawBytes {
+		return strconv.FormatInt(n, 10)
 	}
-	return int64(stat.Blocks) * stat.Bsize, nil
+	return humanize(n)
 }
 
 type file struct {
@@ -38,264 +56,2292 @@ type file struct {
 	base    string
 	size    int64
 	modTime time.Time
+	// captureTime is the EXIF capture date, or modTime if the file has none.
+	// Only populated when scanOptions.captureTime is set.
+	captureTime time.Time
+	// exif is whether captureTime is from EXIF data.
+	exif bool
+	// hash is the content hash with --dedup, if the file may have duplicates.
+	hash string
+	// from is the path under src with --flatten or --organize-by, see
+	// srcPath.
+	from string
+	// link is the target of a symlink to recreate on dst with
+	// --links=preserve, see linkTarget.
+	link string
 }
 
 func (f *file) path() string {
 	return filepath.Join(f.dir, f.base)
 }
 
-func scan(dir string) ([]*file, error) {
-	var files []*file
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		i, err := d.Info()
-		if err != nil {
-			return err
+type scanOptions struct {
+	captureTime bool // populate file.captureTime
+	// Glob patterns, see match().
+	include []string
+	exclude []string
+	system  []string // junk files and directories to skip
+	protect []string // files and directories to leave out of dst scans
+	// Only take files modified in [after, before). Zero means unbounded.
+	after, before time.Time
+	// settled, if set, leaves out the files modified since, which may still
+	// be being written.
+	settled time.Time
+	// Only take files of [minSize, maxSize] bytes. Zero maxSize means
+	// unbounded.
+	minSize, maxSize int64
+	followSymlinks   bool
+	// links is what to take of symlinked files: their targets with "copy",
+	// or the links themselves with "preserve", skipping broken ones either
+	// way. "resolve" is "copy" taking broken ones as they are, for the links
+	// of --link-only in dst. With "" they are taken as they are.
+	links string
+	// onCopiedLink, if set, gets the paths of the symlinked files whose
+	// targets are taken with "copy".
+	onCopiedLink func(path string)
+	// oneFileSystem skips the directories on other file systems than the
+	// scanned directory, like mount points under it.
+	oneFileSystem bool
+	// list is a file listing the paths to take relative to the scanned
+	// directory, one per line, instead of walking it.
+	list string
+	// With limitDepth, the directories more than maxDepth levels below the
+	// scanned one are skipped, so 0 only takes the files directly in it.
+	limitDepth bool
+	maxDepth   int
+	// workers is the number of goroutines doing the per file work, at least
+	// one.
+	workers int
+	// leaveOut are the paths to skip, e.g. --trash-dir.
+	leaveOut []string
+	// onError, if set, gets the errors about single files and directories.
+	// The scan carries on without them if it returns nil.
+	onError func(error) error
+}
+
+func (r *runner) srcScanOptions() scanOptions {
+	opts := scanOptions{
+		captureTime:    r.SortBy == "exif" || r.OrganizeBy == "exif-date",
+		include:        r.Include,
+		exclude:        r.Exclude,
+		system:         r.systemPatterns(),
+		after:          r.After,
+		before:         r.Before,
+		minSize:        r.MinSize,
+		maxSize:        r.MaxSize,
+		followSymlinks: r.FollowSymlinks,
+		links:          r.Links,
+		oneFileSystem:  r.OneFileSystem,
+		list:           r.SrcList,
+		limitDepth:     r.MaxDepth >= 0,
+		maxDepth:       r.MaxDepth,
+	}
+	if r.Links == "" {
+		opts.links = "copy"
+		if r.Copier == "rsync" && !r.LinkOnly {
+			opts.onCopiedLink = func(path string) {
+				r.copyLinksWarning.Do(func() {
+					log.Printf("Copying the targets of symlinked src files like %s, which rsync used to recreate as links; --links=preserve still does, and --links=copy silences this\n", path)
+				})
+			}
 		}
-		relPath := path[len(dir):]
-		files = append(files, &file{
-			dir:     filepath.Dir(relPath),
-			base:    filepath.Base(relPath),
-			size:    i.Size(),
-			modTime: i.ModTime(),
-		})
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	return files, err
+	if r.MinAge > 0 {
+		opts.settled = time.Now().Add(-r.MinAge)
+	}
+	return opts
 }
 
-func mostRecent(files []*file, cap int64) []*file {
-	slices.SortFunc(files, func(a, b *file) int {
-		return b.modTime.Compare(a.modTime)
-	})
-	var totalSize int64
-	var ret []*file
-	for _, f := range files {
-		if (totalSize+f.size)*20 > cap*19 { // 95%
-			break
+// match reports whether relPath matches any of patterns. Patterns without a
+// separator are matched against the base name, so "*.xmp" matches sidecars in
+// any directory, while the others are matched against the whole relative path.
+func match(patterns []string, relPath string) bool {
+	for _, p := range patterns {
+		name := relPath
+		if !strings.ContainsRune(p, filepath.Separator) {
+			name = filepath.Base(relPath)
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
 		}
-		totalSize += f.size
-		ret = append(ret, f)
 	}
-	log.Printf("Total size to be kept: %d (cap: %d)\n", totalSize, cap)
-	return ret
+	return false
 }
 
-// This function is currently unsed.
-func duplicates(files []*file) {
-	type key struct {
-		base string
-		size int64
+// protected reports whether relPath, a dst path, matches the patterns of
+// protect, unless it is a temporary file to clean up, which a pattern like
+// ".*" would otherwise keep forever.
+func protected(protect []string, relPath string) bool {
+	return match(protect, relPath) && !isTemp(filepath.Base(relPath))
+}
+
+// systemPatterns returns the patterns of --system-files, or nil unless
+// --skip-system-files is in effect.
+func (r *runner) systemPatterns() []string {
+	if !r.SkipSystemFiles {
+		return nil
 	}
-	sm := make(map[key]int64)
-	dm := make(map[key][]string)
-	for _, f := range files {
-		k := key{f.base, f.size}
-		sm[k]++
-		dm[k] = append(dm[k], f.dir)
+	return r.SystemFiles
+}
+
+func (o *scanOptions) skip(relPath string) bool {
+	if match(o.system, relPath) {
+		return true
 	}
-	var totalDuplicateSize int64
-	for k, v := range sm {
-		if v == 1 {
-			continue
-		}
-		/*
-			fmt.Printf("Duplicate: %s %d (%d copies)\n", k.base, k.size, v)
-			for _, d := range dm[k] {
-				fmt.Println("-", d)
-			}
-		*/
-		totalDuplicateSize += k.size * (v - 1)
+	if match(o.exclude, relPath) {
+		return true
 	}
-	fmt.Printf("Total duplicate size: %d\n", totalDuplicateSize)
+	return len(o.include) > 0 && !match(o.include, relPath)
 }
 
-func compare(src, dst []*file) (add, sub []*file) {
-	sm := make(map[string]bool)
-	dm := make(map[string]bool)
-	for _, f := range src {
-		sm[f.path()] = true
+// keep reports whether f passes the filters on its metadata.
+func (o *scanOptions) keep(f *file) bool {
+	if !o.after.IsZero() && f.modTime.Before(o.after) {
+		return false
 	}
-	for _, f := range dst {
-		dm[f.path()] = true
+	if !o.before.IsZero() && !f.modTime.Before(o.before) {
+		return false
 	}
+	return true
+}
 
-	for _, f := range src {
-		if !dm[f.path()] {
-			add = append(add, f)
-		}
+// sized reports whether f passes the filters on its size.
+func (o *scanOptions) sized(f *file) bool {
+	return o.minSize <= f.size && (o.maxSize == 0 || f.size <= o.maxSize)
+}
+
+// walkDir is filepath.WalkDir, except that with follow set it descends into
+// symlinked directories as if they were regular ones, reporting their contents
+// under the path of the link. Each directory is walked at most once so that
+// symlink cycles terminate.
+func walkDir(root string, follow bool, fn fs.WalkDirFunc) error {
+	type key struct {
+		dev uint64
+		ino uint64
 	}
-	for _, f := range dst {
-		if !sm[f.path()] {
-			sub = append(sub, f)
+	visited := make(map[key]bool)
+	// seen reports whether the directory at path has been walked already.
+	seen := func(path string) bool {
+		dev, ino, ok := fileID(path)
+		if !ok {
+			return false
+		}
+		k := key{dev, ino}
+		if visited[k] {
+			return true
 		}
+		visited[k] = true
+		return false
 	}
-	return
+	var walk func(root string) error
+	walk = func(root string) error {
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			// Drop the trailing separator we add to walk into links.
+			path = filepath.Clean(path)
+			if err != nil || !follow {
+				return fn(path, d, err)
+			}
+			if d.IsDir() {
+				if seen(path) {
+					log.Printf("Not walking %s again (symlink cycle?)\n", path)
+					return fs.SkipDir
+				}
+			} else if d.Type()&fs.ModeSymlink != 0 {
+				if i, err := os.Stat(path); err == nil && i.IsDir() {
+					// WalkDir doesn't follow a symlinked root either, unless
+					// it has a trailing separator.
+					return walk(path + string(filepath.Separator))
+				}
+			}
+			return fn(path, d, nil)
+		})
+	}
+	// Walk into root even if it's a symlink.
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return walk(root)
 }
 
-func removeEmptyDirs(dir string) error {
-	// Process directories in the opposite order as WalkDir so that we can
-	// recursively delete empty directories in one path.
-	var dirs []string
-	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+// walkList calls fn like filepath.WalkDir would for the files under dir listed
+// in list. Listed files which don't exist or aren't regular are warned about
+// and skipped.
+func walkList(dir, list string, fn fs.WalkDirFunc) error {
+	l, err := os.Open(list)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	s := bufio.NewScanner(l)
+	for s.Scan() {
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		rel := filepath.Clean(filepath.FromSlash(line))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Printf("Skipping %s listed in %s: not relative to %s\n", line, list, dir)
+			continue
+		}
+		path := filepath.Join(dir, rel)
+		i, err := os.Stat(path)
 		if err != nil {
-			return err
+			log.Printf("Skipping %s listed in %s: %v\n", line, list, err)
+			continue
 		}
-		if d.IsDir() {
-			dirs = append(dirs, path)
+		if !i.Mode().IsRegular() {
+			log.Printf("Skipping %s listed in %s: not a regular file\n", line, list)
+			continue
+		}
+		if err := fn(path, fs.FileInfoToDirEntry(i), nil); err != nil {
+			return err
 		}
-		return nil
-	}); err != nil {
-		return err
 	}
-	for i := len(dirs) - 1; i >= 0; i-- {
-		// https://stackoverflow.com/questions/30697324/how-to-check-if-directory-on-path-is-empty
-		empty, err := func() (bool, error) {
-			f, err := os.Open(dirs[i])
-			if err != nil {
-				return false, err
-			}
-			defer f.Close()
-			_, err = f.Readdirnames(1)
-			if err == io.EOF {
-				return true, nil
+	return s.Err()
+}
+
+// scan returns the files under dir. The directory tree is walked
+// sequentially, while the per file work (stat, EXIF) is done by opts.workers
+// goroutines.
+func scan(ctx context.Context, dir string, opts scanOptions) ([]*file, error) {
+	leaveOut, err := relPaths(dir, opts.leaveOut)
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		path    string
+		relPath string
+		d       fs.DirEntry
+	}
+	var (
+		mu       sync.Mutex
+		files    []*file
+		noExif   int
+		firstErr error
+		// The files left out for their size, and their bytes.
+		unsized     int
+		unsizedSize int64
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+
+	ch := make(chan entry)
+	var wg sync.WaitGroup
+	for i := 0; i < max(opts.workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range ch {
+				i, err := e.d.Info()
+				var link string
+				if err == nil && opts.links != "" && i.Mode()&fs.ModeSymlink != 0 {
+					t, terr := os.Stat(e.path)
+					switch {
+					case terr != nil && opts.links == "resolve":
+					case terr != nil:
+						report("broken-link", fmt.Sprintf("Skipping %s: broken symlink", e.relPath), "path", e.relPath)
+						continue
+					case t.IsDir():
+						// Walked already if it is to be.
+						continue
+					case opts.links == "copy" || opts.links == "resolve":
+						i = t
+						if opts.onCopiedLink != nil {
+							opts.onCopiedLink(e.relPath)
+						}
+					default:
+						link, err = linkTarget(dir, e.path)
+					}
+				}
+				if err != nil && opts.onError != nil {
+					if err = opts.onError(err); err == nil {
+						continue
+					}
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				f := &file{
+					dir:     filepath.Dir(e.relPath),
+					base:    filepath.Base(e.relPath),
+					size:    i.Size(),
+					modTime: i.ModTime(),
+					link:    link,
+				}
+				if link != "" {
+					// As the copy will be, which may differ from the
+					// original.
+					f.size = int64(len(link))
+				}
+				if !opts.keep(f) {
+					slog.Debug(fmt.Sprintf("Skipping %s: filtered by metadata", e.relPath))
+					continue
+				}
+				if !opts.settled.IsZero() && !f.modTime.Before(opts.settled) {
+					slog.Debug(fmt.Sprintf("Skipping %s: modified within --min-age, until the next run", e.relPath))
+					continue
+				}
+				if !opts.sized(f) {
+					slog.Debug(fmt.Sprintf("Skipping %s: filtered by size", e.relPath))
+					mu.Lock()
+					unsized++
+					unsizedSize += f.size
+					mu.Unlock()
+					continue
+				}
+				exif := true
+				if opts.captureTime {
+					// Unreadable or missing EXIF data is not worth failing for.
+					if t, err := captureTime(e.path); err == nil {
+						f.captureTime, f.exif = t, true
+					} else {
+						f.captureTime = f.modTime
+						exif = false
+					}
+				}
+				mu.Lock()
+				files = append(files, f)
+				if !exif {
+					noExif++
+				}
+				mu.Unlock()
 			}
-			return false, err // Either not empty or error, suits both cases
 		}()
-		if err != nil {
-			return err
+	}
+
+	var symlinkedDirs, otherDevices []string
+	var rootDev uint64
+	rootOK := false
+	if opts.oneFileSystem {
+		rootDev, _, rootOK = fileID(dir)
+	}
+	walk := func(fn fs.WalkDirFunc) error {
+		if opts.list != "" {
+			return walkList(dir, opts.list, fn)
 		}
-		if empty {
-			fmt.Printf("deleting empty dir %s\n", dirs[i])
-			if err := os.Remove(dirs[i]); err != nil {
+		return walkDir(dir, opts.followSymlinks, fn)
+	}
+	err = walk(func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Not being able to read dir itself is no single file.
+			if opts.onError == nil || path == filepath.Clean(dir) {
+				return err
+			}
+			if err := opts.onError(err); err != nil {
 				return err
 			}
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
 		}
-	}
-	return nil
-}
-
-func updateDirAttributes() error {
-	return filepath.WalkDir(*src, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
+		// Stop walking as soon as a worker fails.
+		if err := failed(); err != nil {
 			return err
 		}
-		if !d.IsDir() {
-			return nil
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-
-		si, err := d.Info()
+		relPath, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
-
-		relPath := path[len(*src):]
-		dstPath := filepath.Join(*dst, relPath)
-		di, err := os.Stat(dstPath)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return nil
-			} else {
-				return err
+		switch relPath {
+		case manifestName, lockName:
+			return nil
+		case trashName:
+			return fs.SkipDir
+		}
+		if leaveOut[relPath] {
+			if d.IsDir() {
+				return fs.SkipDir
 			}
+			return nil
 		}
-
-		if ss, ok := si.Sys().(*syscall.Stat_t); ok {
-			if ds, ok := di.Sys().(*syscall.Stat_t); ok {
-				if d := si.ModTime().Sub(di.ModTime()); d < -time.Second || time.Second < d { // approx equal?
-					toTime := func(t syscall.Timespec) time.Time {
-						return time.Unix(t.Sec, t.Nsec)
-					}
-					atim := toTime(ss.Atim)
-					mtim := toTime(ss.Mtim)
-					fmt.Printf("chtimes %s (atim:%s=>%s, mtim:%s=>%s)\n",
-						relPath, toTime(ds.Atim), atim, toTime(ds.Mtim), mtim)
-					if err := os.Chtimes(dstPath, atim, mtim); err != nil {
-						return err
-					}
-				}
-				// TODO: Figure out if I want to do this. There are many source
-				// directories with weird mode, and it feels I might as well use 0755
-				// everywhere.
-				if false {
-					if si.Mode() != di.Mode() {
-						fmt.Printf("chmod %s (%s => %s)\n", relPath, di.Mode(), si.Mode())
-						if false {
-							if err := os.Chmod(dstPath, si.Mode()); err != nil {
-								return err
-							}
-						}
-					}
+		if relPath != "." && protected(opts.protect, relPath) {
+			slog.Debug(fmt.Sprintf("Skipping %s: protected", relPath))
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// The levels of directories below dir which path is in, or which it
+		// is for a directory.
+		levels := strings.Count(relPath, string(filepath.Separator))
+		if d.IsDir() && relPath != "." {
+			levels++
+		}
+		if opts.limitDepth && levels > opts.maxDepth {
+			slog.Debug(fmt.Sprintf("Skipping %s: deeper than --max-depth", relPath))
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			// Like .git or Synology's @eaDir, junk may come as whole trees.
+			if relPath != "." && match(opts.system, relPath) {
+				slog.Debug(fmt.Sprintf("Skipping %s: system directory", relPath))
+				return fs.SkipDir
+			}
+			if rootOK && relPath != "." {
+				if dev, _, ok := fileID(path); ok && dev != rootDev {
+					otherDevices = append(otherDevices, relPath)
+					return fs.SkipDir
 				}
 			}
+			return nil
 		}
-
+		if opts.skip(relPath) {
+			slog.Debug(fmt.Sprintf("Skipping %s: filtered by name", relPath))
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 && !opts.followSymlinks {
+			if i, err := os.Stat(path); err == nil && i.IsDir() {
+				symlinkedDirs = append(symlinkedDirs, relPath)
+			}
+		}
+		ch <- entry{path, relPath, d}
 		return nil
 	})
+	close(ch)
+	wg.Wait()
+	if err == nil {
+		err = firstErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(symlinkedDirs) > 0 {
+		log.Printf("Not following %d symlinked directories in %s (see --follow-symlinks): %s\n",
+			len(symlinkedDirs), dir, strings.Join(symlinkedDirs, ", "))
+	}
+	if unsized > 0 {
+		slog.Debug(fmt.Sprintf("Left out %d files (%s) in %s by their size", unsized, humanize(unsizedSize), dir),
+			"files", unsized, "size", unsizedSize)
+	}
+	if len(otherDevices) > 0 {
+		log.Printf("Not descending into %d directories on other file systems in %s: %s\n",
+			len(otherDevices), dir, strings.Join(otherDevices, ", "))
+	}
+	if noExif > 0 {
+		log.Printf("No EXIF capture date for %d files in %s, using mtime\n", noExif, dir)
+	}
+	// Workers finish in arbitrary order; keep the result deterministic.
+	slices.SortFunc(files, func(a, b *file) int {
+		return cmp.Compare(a.path(), b.path())
+	})
+	return files, nil
 }
 
-func run() error {
-	files, err := scan(*src)
+// scanDir is scan with the workers and trash of r, reporting the result with
+// --log-format=json.
+func (r *runner) scanDir(ctx context.Context, dir string, opts scanOptions) ([]*file, error) {
+	opts.workers = r.ScanWorkers
+	opts.leaveOut = []string{r.TrashDir, r.ChecksumDB}
+	opts.onError = r.ignore
+	files, err := scan(ctx, dir, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cap, err := stat(*dst)
-	if err != nil {
-		return err
+	if r.jsonLogs() {
+		report("scan-complete", fmt.Sprintf("Scanned %d files in %s", len(files), dir),
+			"dir", dir, "files", len(files), "size", totalSize(files))
 	}
-	srcFiles := mostRecent(files, cap)
-	dstFiles, err := scan(*dst)
-	if err != nil {
-		return err
+	return files, nil
+}
+
+// usable returns how many bytes may be filled on a storage of the given
+// capacity, i.e. min(cap*fillPct/100, cap-reserve).
+func (r *runner) usable(cap int64) (int64, error) {
+	if r.Reserve >= cap {
+		return 0, fmt.Errorf("--reserve=%s leaves no space on dst (cap: %s)", r.formatSize(r.Reserve), r.formatSize(cap))
 	}
-	add, sub := compare(srcFiles, dstFiles)
+	return min(cap*int64(r.FillPct)/100, cap-r.Reserve), nil
+}
 
-	for _, f := range sub {
-		path := filepath.Join(*dst, f.path())
-		fmt.Printf("deleting %s\n", path)
-		if err := os.Remove(path); err != nil {
-			return err
+// key returns the time f is prioritized by, its capture date with
+// --sort-by=exif or its mtime otherwise.
+func (r *runner) key(f *file) time.Time {
+	if r.SortBy == "exif" {
+		return f.captureTime
+	}
+	return f.modTime
+}
+
+// order is the order mostRecent selects files in, newest first, or smallest
+// first with --sort-by=size.
+func (r *runner) order(a, b *file) int {
+	if r.SortBy == "size" {
+		if c := cmp.Compare(a.size, b.size); c != 0 {
+			return c
 		}
 	}
-	if err := removeEmptyDirs(*dst); err != nil {
-		return err
+	if c := r.key(b).Compare(r.key(a)); c != 0 {
+		return c
 	}
+	// Ties are broken by path, then size, so that files sharing an mtime, as
+	// after a bulk copy, don't flap in and out at the budget boundary
+	// between runs.
+	if c := cmp.Compare(a.path(), b.path()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.size, b.size)
+}
 
-	file, err := os.CreateTemp("", "*")
-	if err != nil {
-		return err
+// mostRecent selects the most recent files fitting in budget, or the smallest
+// ones with --sort-by=size. The files newer than --always-include-since are
+// always selected, and it's an error if they don't fit. Of the others, only
+// the first --per-dir-limit of each directory are considered. With
+// --group-sidecars, the files sharing a name are selected or skipped together.
+// With --latest-n, the budget only has to hold the newest files.
+func (r *runner) mostRecent(files []*file, budget int64) (kept, skipped []*file, err error) {
+	strategy := map[string]string{
+		"mtime": "newest mtime first",
+		"exif":  "newest capture date first",
+		"size":  "smallest size first, then newest mtime",
+	}[r.SortBy]
+	log.Printf("Selecting by %s\n", strategy)
+	slices.SortFunc(files, r.order)
+	units := r.units(files)
+	p := &picker{runner: r, budget: budget, hashes: make(map[string]bool)}
+	if r.LatestN > 0 {
+		return p.latest(units)
 	}
-	defer os.Remove(file.Name())
-	for _, f := range add {
-		fmt.Fprintln(file, f.path())
+	if r.AlwaysIncludeSince > 0 {
+		since := time.Now().Add(-r.AlwaysIncludeSince)
+		var rest [][]*file
+		for _, u := range units {
+			if r.key(u[0]).After(since) {
+				p.take(u)
+			} else {
+				rest = append(rest, u)
+			}
+		}
+		if p.size > budget {
+			return nil, nil, fmt.Errorf("the %d files since %s (%s) don't fit in the budget of %s",
+				len(p.kept), since.Format(time.DateTime), r.formatSize(p.size), r.formatSize(budget))
+		}
+		if r.MaxFiles > 0 && len(p.kept) > r.MaxFiles {
+			return nil, nil, fmt.Errorf("the %d files since %s exceed --max-files=%d",
+				len(p.kept), since.Format(time.DateTime), r.MaxFiles)
+		}
+		log.Printf("Always including %d files since %s (%s)\n", len(p.kept), since.Format(time.DateTime), r.formatSize(p.size))
+		units = rest
 	}
-	cmd := exec.Command("rsync", "-Pav", "--mkpath", "--files-from="+file.Name(), *src, *dst)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return err
+	if r.PerDirLimit > 0 {
+		// Only the first files of each directory compete for the budget, so
+		// that older directories get some coverage too.
+		n := make(map[string]int)
+		var pool [][]*file
+		for _, u := range units {
+			// The src directory, even with --flatten or --organize-by.
+			dir := filepath.Dir(u[0].srcPath())
+			if n[dir] < r.PerDirLimit {
+				n[dir]++
+				pool = append(pool, u)
+			} else {
+				skipped = append(skipped, u...)
+			}
+		}
+		log.Printf("Taking the first %d files of each of %d directories: %d of %d files\n",
+			r.PerDirLimit, len(n), len(concat(pool)), len(concat(units)))
+		units = pool
 	}
-	if err := updateDirAttributes(); err != nil {
-		return err
+	var alone *picker
+	if r.GroupSidecars {
+		alone = p.clone()
+		alone.fill(units1(concat(units)))
+	}
+	f := p.fill(units)
+	skipped = append(skipped, f.skipped...)
+	if r.Pack {
+		log.Printf("Packing skipped %d files which didn't fit and kept %d older files (%s) instead\n",
+			f.misfits, f.packed, r.formatSize(f.packedSize))
+	}
+	if alone != nil {
+		r.reportGrouping(p.kept, alone.kept)
+	}
+	if r.PerDirLimit > 0 {
+		// In order like the rest.
+		slices.SortStableFunc(skipped, r.order)
+	}
+	log.Printf("Total size to be kept: %s (budget: %s)\n", r.formatSize(p.size), r.formatSize(budget))
+	if f.bound != "" {
+		log.Printf("Keeping %d of %d files, bound by %s\n", len(p.kept), len(p.kept)+len(skipped), f.bound)
+	}
+	return p.kept, skipped, nil
+}
+
+// latest takes the first --latest-n files of units, however large, and fails
+// if they don't fit in the budget.
+func (p *picker) latest(units [][]*file) (kept, skipped []*file, err error) {
+	i := 0
+	for ; i < len(units) && len(p.kept) < p.LatestN; i++ {
+		p.take(units[i])
 	}
+	if p.size > p.budget {
+		return nil, nil, fmt.Errorf("the %d newest files (%s) don't fit in the budget of %s",
+			len(p.kept), p.formatSize(p.size), p.formatSize(p.budget))
+	}
+	skipped = concat(units[i:])
+	log.Printf("Keeping the %d newest files: %s (budget: %s)\n", len(p.kept), p.formatSize(p.size), p.formatSize(p.budget))
+	return p.kept, skipped, nil
+}
 
-	return nil
+// picker is the selection of mostRecent so far.
+type picker struct {
+	*runner
+
+	budget int64
+	size   int64 // of kept, as allocated
+	kept   []*file
+	// With --dedup, duplicates of kept files take no space.
+	hashes map[string]bool
+}
+
+func (p *picker) clone() *picker {
+	q := *p
+	q.kept = slices.Clone(p.kept)
+	q.hashes = maps.Clone(p.hashes)
+	return &q
 }
 
-func main() {
-	flag.Parse()
-	*src = filepath.Clean(*src)
-	*dst = filepath.Clean(*dst)
-	if err := run(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// cost returns the space taking the files of u adds.
+func (p *picker) cost(u []*file) int64 {
+	var n int64
+	for _, f := range u {
+		if f.hash == "" || !p.hashes[f.hash] {
+			n += p.allocated(f.size)
+		}
+	}
+	return n
+}
+
+func (p *picker) take(u []*file) {
+	p.size += p.cost(u)
+	p.kept = append(p.kept, u...)
+	for _, f := range u {
+		if f.hash != "" {
+			p.hashes[f.hash] = true
+		}
+	}
+}
+
+// filled is how fill went.
+type filled struct {
+	skipped []*file
+	// What ended the selection, if anything.
+	bound string
+	// With --pack, the files skipped as they didn't fit, and the older ones
+	// kept after them.
+	misfits, packed int
+	packedSize      int64
+}
+
+// fill takes units in order while they fit in the budget and --max-files.
+func (p *picker) fill(units [][]*file) filled {
+	var f filled
+	for i, u := range units {
+		if p.MaxFiles > 0 && len(p.kept)+len(u) > p.MaxFiles {
+			f.bound = "--max-files"
+			f.skipped = append(f.skipped, concat(units[i:])...)
+			break
+		}
+		if p.size == p.budget {
+			f.bound = "the budget"
+			f.skipped = append(f.skipped, concat(units[i:])...)
+			break
+		}
+		if p.size+p.cost(u) > p.budget {
+			f.bound = "the budget"
+			// With --pack, files which don't fit are skipped instead of
+			// ending the selection, so that smaller older files may fill
+			// up the rest.
+			if !p.Pack {
+				f.skipped = append(f.skipped, concat(units[i:])...)
+				break
+			}
+			f.misfits += len(u)
+			f.skipped = append(f.skipped, u...)
+			continue
+		}
+		p.take(u)
+		if f.misfits > 0 {
+			f.packed += len(u)
+			f.packedSize += totalSize(u)
+		}
+	}
+	return f
+}
+
+// reportSkipped prints the files which didn't fit in the budget, newest first,
+// with the additional capacity needed to include everything down to each.
+func (r *runner) reportSkipped(skipped []*file) {
+	var need int64
+	for _, f := range skipped {
+		need += f.size
+		report("skipped", fmt.Sprintf("skipped %s (%s), need %s more to include down to %s",
+			f.path(), r.formatSize(f.size), r.formatSize(need), f.modTime.Format(time.DateTime)),
+			"path", f.path(), "size", f.size, "mod_time", f.modTime, "need", need)
+	}
+	if len(skipped) > 0 {
+		log.Printf("%d files (%s) didn't fit in the budget\n", len(skipped), r.formatSize(need))
+	}
+}
+
+// reportExtensions prints the number and total size of files by extension,
+// largest first, labeled with what files are.
+func (r *runner) reportExtensions(what string, files []*file) {
+	type stats struct {
+		ext   string
+		files int
+		size  int64
+	}
+	m := make(map[string]*stats)
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.base))
+		if ext == "" {
+			ext = "(none)"
+		}
+		if m[ext] == nil {
+			m[ext] = &stats{ext: ext}
+		}
+		m[ext].files++
+		m[ext].size += f.size
+	}
+	var exts []*stats
+	for _, s := range m {
+		exts = append(exts, s)
+	}
+	slices.SortFunc(exts, func(a, b *stats) int {
+		if c := cmp.Compare(b.size, a.size); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ext, b.ext)
+	})
+	for _, s := range exts {
+		report("extension", fmt.Sprintf("%s %s: %d files (%s)", what, s.ext, s.files, r.formatSize(s.size)),
+			"of", what, "ext", s.ext, "files", s.files, "size", s.size)
+	}
+}
+
+// reportOnly reports whether the run only reports on src and dst, with
+// --stat-only, --report-duplicates or --report-coverage.
+func (r *runner) reportOnly() bool {
+	return r.StatOnly || r.ReportDuplicates || r.ReportCoverage || r.DiffManifest != ""
+}
+
+// printStats prints the size and date range of files and, with --dst, how
+// much of them would fit there. It doesn't touch dst.
+func (r *runner) printStats(ctx context.Context, files []*file) error {
+	if len(files) == 0 {
+		summary("stats", "No files in src", "files", 0)
+		return nil
+	}
+	first, newest := oldest(files), files[0].modTime
+	for _, f := range files {
+		if f.modTime.After(newest) {
+			newest = f.modTime
+		}
+	}
+	summary("stats", fmt.Sprintf("src: %d files (%s) from %s to %s",
+		len(files), r.formatSize(totalSize(files)), first.Format(time.DateTime), newest.Format(time.DateTime)),
+		"files", len(files), "size", totalSize(files), "oldest", first, "newest", newest)
+	if len(r.Dst) == 0 {
+		return nil
+	}
+	var budget int64
+	for _, dir := range r.Dst {
+		cap, err := r.capacity(ctx, dir)
+		if err != nil {
+			return err
+		}
+		b, err := r.usable(cap)
+		if err != nil {
+			return err
+		}
+		budget += b
+	}
+	kept, skipped, err := r.mostRecent(slices.Clone(files), budget)
+	if err != nil {
+		return err
+	}
+	since := oldest(kept)
+	summary("stats-fit", fmt.Sprintf("dst: %s usable, fits %d files (%s) down to %s, leaving out %d files (%s)",
+		r.formatSize(budget), len(kept), r.formatSize(totalSize(kept)), since.Format(time.DateTime), len(skipped), r.formatSize(totalSize(skipped))),
+		"budget", budget, "files", len(kept), "size", totalSize(kept), "since", since,
+		"skipped", len(skipped), "skipped_size", totalSize(skipped))
+	return nil
+}
+
+// oldest returns the earliest mtime of files, or zero if there are none.
+func oldest(files []*file) time.Time {
+	var t time.Time
+	for _, f := range files {
+		if t.IsZero() || f.modTime.Before(t) {
+			t = f.modTime
+		}
+	}
+	return t
+}
+
+// newest returns the latest mtime of files, or zero if there are none.
+func newest(files []*file) time.Time {
+	var t time.Time
+	for _, f := range files {
+		if f.modTime.After(t) {
+			t = f.modTime
+		}
+	}
+	return t
+}
+
+// relPaths returns the paths which are under dir relative to it.
+func relPaths(dir string, paths []string) (map[string]bool, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	rel := make(map[string]bool)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		if r, err := filepath.Rel(abs, p); err == nil && r != "." && !strings.HasPrefix(r, "..") {
+			rel[r] = true
+		}
+	}
+	return rel, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// duplicates prints the groups of files under dir sharing the same base name
+// and size, and the total size that could be reclaimed by removing the extra
+// copies. If hash is true, files in a group must also have the same content.
+func (r *runner) duplicates(files []*file, hash bool) error {
+	type key struct {
+		base string
+		size int64
+		hash string
+	}
+	dm := make(map[key][]string)
+	for _, f := range files {
+		k := key{base: f.base, size: f.size}
+		dm[k] = append(dm[k], f.dir)
+	}
+	if hash {
+		hm := make(map[key][]string)
+		for k, dirs := range dm {
+			if len(dirs) == 1 {
+				continue
+			}
+			for _, d := range dirs {
+				h, err := r.hash(r.srcFile(filepath.Join(d, k.base)))
+				if err != nil {
+					return err
+				}
+				hk := k
+				hk.hash = h
+				hm[hk] = append(hm[hk], d)
+			}
+		}
+		dm = hm
+	}
+	var keys []key
+	for k, v := range dm {
+		if len(v) > 1 {
+			keys = append(keys, k)
+		}
+	}
+	// Largest savings first.
+	slices.SortFunc(keys, func(a, b key) int {
+		if c := cmp.Compare(b.size*int64(len(dm[b])-1), a.size*int64(len(dm[a])-1)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.base, b.base)
+	})
+	var totalDuplicateSize int64
+	for _, k := range keys {
+		v := int64(len(dm[k]))
+		if r.jsonLogs() {
+			report("duplicate", fmt.Sprintf("Duplicate: %s", k.base),
+				"base", k.base, "size", k.size, "copies", v, "paths", dm[k])
+		} else {
+			fmt.Printf("Duplicate: %s %s (%d copies)\n", k.base, r.formatSize(k.size), v)
+			for _, d := range dm[k] {
+				fmt.Println("-", d)
+			}
+		}
+		totalDuplicateSize += k.size * (v - 1)
+	}
+	summary("duplicate-summary", fmt.Sprintf("Total duplicate size: %s", r.formatSize(totalDuplicateSize)),
+		"size", totalDuplicateSize)
+	return nil
+}
+
+func totalSize(files []*file) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	return size
+}
+
+// detectBlockSize sets block from the destinations.
+func (r *runner) detectBlockSize() error {
+	for _, dir := range r.Dst {
+		b, err := blockSize(dir)
+		if err != nil {
+			return err
+		}
+		log.Printf("Block size of %s: %s\n", dir, r.formatSize(b))
+		r.block = max(r.block, b)
+	}
+	return nil
+}
+
+// allocated returns the space a file of size takes up in dst, which is size
+// rounded up to whole blocks with --account-blocksize.
+func (r *runner) allocated(size int64) int64 {
+	if r.block <= 1 {
+		return size
+	}
+	return (size + r.block - 1) / r.block * r.block
+}
+
+// allocatedSize is totalSize in terms of allocated.
+func (r *runner) allocatedSize(files []*file) int64 {
+	var size int64
+	for _, f := range files {
+		size += r.allocated(f.size)
+	}
+	return size
+}
+
+// compare returns the files of src to be copied to dst, which are those
+// missing from dst or to be overwritten there by --overwrite-policy, and the
+// files of dst not in src.
+//
+// With fold set or --case-insensitive, paths differing only in case are the
+// same file, as they are on FAT and exFAT. The files returned keep their own
+// paths, so a file of dst is deleted under the name it has there.
+func (r *runner) compare(src, dst []*file, fat, fold bool) (add, sub []*file) {
+	key := func(f *file) string {
+		if fold || r.CaseInsensitive {
+			return strings.ToLower(f.path())
+		}
+		return f.path()
+	}
+	sm := make(map[string]bool)
+	dm := make(map[string]*file)
+	for _, f := range src {
+		sm[key(f)] = true
+	}
+	for _, f := range dst {
+		dm[key(f)] = f
+	}
+
+	for _, f := range src {
+		d, ok := dm[key(f)]
+		if !ok || r.overwrites(f, d, fat) {
+			add = append(add, f)
+		}
+	}
+	for _, f := range dst {
+		if !sm[key(f)] {
+			sub = append(sub, f)
+		}
+	}
+	return
+}
+
+// overwrites reports whether the file d of dst is to be overwritten with f of
+// src by --overwrite-policy. By default it is if it changed since it was
+// copied: its size differs or f is newer by more than tolerance(fat).
+func (r *runner) overwrites(f, d *file, fat bool) bool {
+	newer := f.modTime.Sub(d.modTime) > r.tolerance(fat)
+	switch r.OverwritePolicy {
+	case "always":
+		return true
+	case "newer":
+		return newer
+	case "size":
+		return d.size != f.size
+	case "never":
+		return false
+	}
+	return d.size != f.size || newer
+}
+
+// removeEmptyDirs removes the empty directories under dir, except for dir
+// itself, those matching --keep-dirs and those on other file systems.
+// Symlinked directories aren't followed.
+func (r *runner) removeEmptyDirs(dir string) error {
+	rootDev, _, rootOK := fileID(dir)
+	// Process directories in the opposite order as WalkDir so that we can
+	// recursively delete empty directories in one path.
+	var dirs []string
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == dir {
+			return nil
+		}
+		if dev, _, ok := fileID(path); ok && rootOK && dev != rootDev {
+			return fs.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	}); err != nil {
+		return err
+	}
+	slices.Reverse(dirs)
+	return r.pruneDirs(dir, dirs)
+}
+
+// removeEmptyParents is removeEmptyDirs for only the directories which held
+// the removed paths, and their parents, so that the rest of dir needn't be
+// walked.
+func (r *runner) removeEmptyParents(dir string, removed []string) error {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, path := range removed {
+		for p := filepath.Dir(path); p != dir && !seen[p]; p = filepath.Dir(p) {
+			if rel, err := filepath.Rel(dir, p); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				break
+			}
+			seen[p] = true
+			dirs = append(dirs, p)
+		}
+	}
+	// Children before their parents.
+	depth := func(p string) int { return strings.Count(p, string(filepath.Separator)) }
+	slices.SortFunc(dirs, func(a, b string) int {
+		if c := cmp.Compare(depth(b), depth(a)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return r.pruneDirs(dir, dirs)
+}
+
+// pruneDirs removes those of dirs under dir which are empty, in order.
+func (r *runner) pruneDirs(dir string, dirs []string) error {
+	rootDev, _, rootOK := fileID(dir)
+	for _, path := range dirs {
+		// Leave mount points alone.
+		if dev, _, ok := fileID(path); ok && rootOK && dev != rootDev {
+			continue
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if match(r.KeepDirs, rel) {
+			continue
+		}
+		// https://stackoverflow.com/questions/30697324/how-to-check-if-directory-on-path-is-empty
+		empty, err := func() (bool, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return false, err
+			}
+			defer f.Close()
+			_, err = f.Readdirnames(1)
+			if err == io.EOF {
+				return true, nil
+			}
+			return false, err // Either not empty or error, suits both cases
+		}()
+		if err != nil {
+			return err
+		}
+		if empty {
+			report("rmdir", fmt.Sprintf("deleting empty dir %s", path), "path", path)
+			if r.DryRun {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tolerance returns how far apart mtimes may be while being considered equal:
+// --mtime-tolerance, or 2 seconds if fat is set since FAT rounds them to even
+// seconds (down on Linux, up on Windows).
+func (r *runner) tolerance(fat bool) time.Duration {
+	if fat {
+		return max(r.MtimeTolerance, 2*time.Second)
+	}
+	return r.MtimeTolerance
+}
+
+// sameMtime reports whether the mtimes a and b are equal within tolerance(fat).
+func (r *runner) sameMtime(a, b time.Time, fat bool) bool {
+	tol := r.tolerance(fat)
+	d := a.Sub(b)
+	return -tol <= d && d <= tol
+}
+
+// updateDirAttributes gives the directories of dst the mtimes of those of src,
+// including the ones the copy just created with the current time.
+func (r *runner) updateDirAttributes(src, dst string) error {
+	fat := isFAT(dst)
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		si, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, relPath)
+		di, err := os.Stat(dstPath)
+		if err != nil {
+			// As this runs after the copy, the directories which it created
+			// are already there. Those which aren't hold no kept files, and
+			// neither do their subdirectories.
+			if errors.Is(err, os.ErrNotExist) {
+				return fs.SkipDir
+			} else {
+				return err
+			}
+		}
+
+		if atim, mtim, ok := fileTimes(si); ok {
+			if datim, dmtim, ok := fileTimes(di); ok {
+				if !r.sameMtime(mtim, dmtim, fat) {
+					report("chtimes", fmt.Sprintf("chtimes %s (atim:%s=>%s, mtim:%s=>%s)",
+						relPath, datim, atim, dmtim, mtim),
+						"path", relPath, "atime", atim, "mtime", mtim)
+					if !r.DryRun {
+						if err := r.ignore(os.Chtimes(dstPath, atim, mtim)); err != nil {
+							return err
+						}
+					}
+				}
+				// TODO: Figure out if I want to do this. There are many source
+				// directories with weird mode, and it feels I might as well use 0755
+				// everywhere.
+				if false {
+					if si.Mode() != di.Mode() {
+						fmt.Printf("chmod %s (%s => %s)\n", relPath, di.Mode(), si.Mode())
+						if false {
+							if err := os.Chmod(dstPath, si.Mode()); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// verifyFiles checks that the copies of files on dst match their originals on
+// src, and returns a description of each mismatch.
+func (r *runner) verifyFiles(ctx context.Context, dst string, files []*file) ([]string, error) {
+	check := func(f *file) error {
+		srcPath := r.srcFile(f.srcPath())
+		dstPath := filepath.Join(dst, f.path())
+		si, err := os.Stat(srcPath)
+		if err != nil {
+			return err
+		}
+		di, err := os.Stat(dstPath)
+		if err != nil {
+			return err
+		}
+		if si.Size() != di.Size() {
+			return fmt.Errorf("size mismatch: %d != %d", si.Size(), di.Size())
+		}
+		if !r.VerifyHash {
+			return nil
+		}
+		sh, err := r.hash(srcPath)
+		if err != nil {
+			return err
+		}
+		dh, err := r.rehash(dstPath)
+		if err != nil {
+			return err
+		}
+		if sh != dh {
+			return fmt.Errorf("hash mismatch: %s != %s", sh, dh)
+		}
+		return nil
+	}
+
+	ch := make(chan *file)
+	var mu sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+	for i := 0; i < r.VerifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ch {
+				if err := check(f); err != nil {
+					mu.Lock()
+					failed = append(failed, fmt.Sprintf("%s: %v", filepath.Join(dst, f.path()), err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for _, f := range files {
+		select {
+		case ch <- f:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(failed)
+	return failed, nil
+}
+
+// preserves reports whether attr is in --preserve.
+func (r *runner) preserves(attr string) bool {
+	return slices.Contains(r.Preserve, attr)
+}
+
+func (r *runner) rsyncArgs(filesFrom, dst string) []string {
+	args := strings.Fields(r.RsyncOpts)
+	args = append(args, "--mkpath", "--files-from="+filesFrom)
+	switch r.Links {
+	case "", "copy":
+		args = append(args, "--copy-links")
+	case "preserve":
+		args = append(args, "--links")
+	}
+	if r.Xattrs {
+		args = append(args, "--xattrs")
+	}
+	// So that rsync's own check doesn't undo what compare chose.
+	switch r.OverwritePolicy {
+	case "always":
+		args = append(args, "--ignore-times")
+	case "newer":
+		args = append(args, "--update")
+	case "size":
+		args = append(args, "--size-only")
+	case "never":
+		args = append(args, "--ignore-existing")
+	}
+	if r.BWLimit > 0 {
+		// rsync takes KiB/s.
+		args = append(args, fmt.Sprintf("--bwlimit=%d", max(r.BWLimit/1024, 1)))
+	}
+	if isRemote(dst) && r.RemoteShell != "ssh" {
+		args = append(args, "--rsh="+r.RemoteShell)
+	}
+	args = append(args, r.RsyncFlags...)
+	return append(args, r.Src, dst)
+}
+
+// destination is one of the --dst directories.
+type destination struct {
+	*runner
+
+	dir      string
+	files    []*file // currently in dir
+	budget   int64
+	manifest *manifest // of the previous run, if any
+	fat      bool
+	fold     bool // whether dir ignores the case of names
+
+	keep     []*file         // selected files to be stored in dir
+	used     int64           // total size of keep, counting duplicates once
+	hashes   map[string]bool // of keep, with --dedup
+	add, sub []*file
+	links    []link // with --dedup, duplicates of other files in keep
+	moves    []move // with --dedupe-across-src-dst, files of dir to rename
+
+	// noSpace is set if dir ran out of space partway through the copy,
+	// with add and keep cut down to what was copied.
+	noSpace error
+
+	// How far sync got.
+	mu              sync.Mutex // guards the following while removing
+	removed, copied int
+	retries         map[string]int // by file or "rsync"
+}
+
+// scanDst returns the files in the destination dir.
+func (r *runner) scanDst(ctx context.Context, dir string) ([]*file, error) {
+	// What src is skipped of is left alone on dst too, rather than
+	// deleted as unselected, like the dotfiles of earlier runs.
+	opts := scanOptions{protect: append(slices.Clone(r.DstProtect), r.systemPatterns()...)}
+	if isRemote(dir) {
+		return r.scanRemote(ctx, dir, opts)
+	}
+	if r.LinkOnly && !r.Hardlink {
+		// So that the links compare equal to their targets.
+		opts.links = "resolve"
+	}
+	return r.scanDir(ctx, dir, opts)
+}
+
+func (r *runner) newDestination(ctx context.Context, dir string) (*destination, error) {
+	endScan := r.phase("dst scan")
+	files, err := r.scanDst(ctx, dir)
+	endScan()
+	if err != nil {
+		return nil, err
+	}
+	var cap int64
+	if r.UseAvail {
+		// Everything in dir is either kept or deleted, so the space it uses
+		// is ours to budget too.
+		free, err := r.free(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		cap = free + totalSize(files)
+	} else if cap, err = r.capacity(ctx, dir); err != nil {
+		return nil, err
+	}
+	budget, err := r.usable(cap)
+	if err != nil {
+		return nil, err
+	}
+	if r.trashing() && onSameDevice(dir, r.trashOf(dir)) {
+		// The trash takes up space too. Files trashed by this run are only
+		// accounted for in the next one.
+		trash, err := dirSize(r.trashOf(dir))
+		if err != nil {
+			return nil, err
+		}
+		budget -= trash
+		log.Printf("Trash in %s: %s\n", dir, r.formatSize(trash))
+	}
+	log.Printf("Capacity of %s: %s, usable: %s\n", dir, r.formatSize(cap), r.formatSize(budget))
+	m, err := r.readManifestOf(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading the manifest of %s: %w", dir, err)
+	}
+	return &destination{runner: r, dir: dir, files: files, budget: budget, manifest: m, fat: !isRemote(dir) && isFAT(dir), fold: !isRemote(dir) && foldsCase(dir)}, nil
+}
+
+// cost returns the space f would take in d, which is nothing for a duplicate
+// of a file already kept with --dedup.
+func (d *destination) cost(f *file) int64 {
+	if f.hash != "" && d.hashes[f.hash] {
+		return 0
+	}
+	return d.allocated(f.size)
+}
+
+func (d *destination) fits(f *file) bool {
+	return d.used+d.cost(f) <= d.budget
+}
+
+func (d *destination) take(f *file) {
+	d.used += d.cost(f)
+	d.keep = append(d.keep, f)
+	if f.hash != "" {
+		if d.hashes == nil {
+			d.hashes = make(map[string]bool)
+		}
+		d.hashes[f.hash] = true
+	}
+}
+
+// place distributes files over dests. Files already stored in one of dests
+// stay there as long as they fit, and the others go wherever --placement
+// says.
+func (r *runner) place(files []*file, dests []*destination) {
+	where := make(map[string]*destination)
+	for _, d := range dests {
+		for _, f := range d.files {
+			if _, ok := where[f.path()]; !ok {
+				where[f.path()] = d
+			}
+		}
+	}
+	var rest []*file
+	for _, f := range files {
+		if d, ok := where[f.path()]; ok && d.fits(f) {
+			d.take(f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	for _, f := range rest {
+		var best *destination
+		for _, d := range dests {
+			if !d.fits(f) {
+				continue
+			}
+			if best == nil || d.budget-d.used > best.budget-best.used {
+				best = d
+			}
+			if r.Placement == "fill-first" {
+				break
+			}
+		}
+		if best == nil {
+			log.Printf("No room for %s on any destination, skipping\n", f.path())
+			continue
+		}
+		best.take(f)
+	}
+}
+
+// checkFree makes sure that d would have at least --min-free-after bytes
+// available after the sync.
+func (d *destination) checkFree(ctx context.Context) error {
+	free, err := d.free(ctx, d.dir)
+	if err != nil {
+		return err
+	}
+	net := totalSize(d.add)
+	if !d.keeping() && !d.trashing() {
+		net -= totalSize(d.sub)
+	}
+	if after := free - net; after < d.MinFreeAfter {
+		return fmt.Errorf("%s would have %s free after adding %s and removing %s (currently free: %s), less than --min-free-after=%s",
+			d.dir, d.formatSize(after), d.formatSize(totalSize(d.add)), d.formatSize(totalSize(d.sub)), d.formatSize(free), d.formatSize(d.MinFreeAfter))
+	}
+	return nil
+}
+
+// dropIdentical removes from d.add the files whose copy in d.dir has the same
+// content, which compare only judges by size and mtime, so that neither
+// rsync nor the native copier has to look at them.
+func (d *destination) dropIdentical(ctx context.Context) error {
+	present := make(map[string]*file)
+	for _, f := range d.files {
+		present[f.path()] = f
+	}
+	var add []*file
+	for _, f := range d.add {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p, ok := present[f.path()]; ok && p.size == f.size {
+			sh, err := d.hash(d.srcFile(f.srcPath()))
+			if err != nil {
+				return err
+			}
+			dh, err := d.hash(filepath.Join(d.dir, f.path()))
+			if err != nil {
+				return err
+			}
+			if sh == dh {
+				continue
+			}
+		}
+		add = append(add, f)
+	}
+	if n := len(d.add) - len(add); n > 0 {
+		log.Printf("%d files are identical to their copies in %s, not copying them\n", n, d.dir)
+	}
+	d.add = add
+	return nil
+}
+
+// trashName is the directory in each destination holding the files removed
+// with --delete-policy=trash.
+const trashName = ".catalog-trash"
+
+// dirSize returns the total size of the files under dir, which may not exist.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		i, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += i.Size()
+		return nil
+	})
+	return size, err
+}
+
+// retain splits files into the ones already in one of dests and the rest. The
+// space used by the files in dests which are not in files at all is reserved
+// in their destination.
+func (r *runner) retain(files []*file, dests []*destination) (present, rest []*file) {
+	srcPaths := make(map[string]bool)
+	for _, f := range files {
+		srcPaths[f.path()] = true
+	}
+	dstPaths := make(map[string]bool)
+	for _, d := range dests {
+		for _, f := range d.files {
+			dstPaths[f.path()] = true
+			if !srcPaths[f.path()] {
+				d.used += r.allocated(f.size)
+			}
+		}
+	}
+	for _, f := range files {
+		if dstPaths[f.path()] {
+			present = append(present, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	return present, rest
+}
+
+// remove gets rid of d.sub according to --delete-policy.
+func (d *destination) remove(ctx context.Context) error {
+	if d.keeping() {
+		if len(d.sub) > 0 {
+			log.Printf("Keeping %d unselected files (%s) in %s\n", len(d.sub), d.formatSize(totalSize(d.sub)), d.dir)
+		}
+		return nil
+	}
+	if isRemote(d.dir) {
+		defer d.phase("delete")()
+		return d.removeRemote(ctx)
+	}
+	removeOne := func(ctx context.Context, path string, f *file) error {
+		if d.trashing() {
+			trashPath := filepath.Join(d.trashOf(d.dir), f.path())
+			report("trash", fmt.Sprintf("trashing %s", path), "path", path, "size", f.size)
+			if d.DryRun {
+				return nil
+			}
+			return d.retry(ctx, path, func() error { return d.moveToTrash(path, trashPath) })
+		}
+		report("delete", fmt.Sprintf("deleting %s", path), "path", path, "size", f.size)
+		if d.DryRun {
+			return nil
+		}
+		return d.retry(ctx, path, func() error { return os.Remove(path) })
+	}
+
+	endDelete := d.phase("delete")
+	// Stops the others on the first failure unless --delete-keep-going.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(d.sub))
+	var removed []string
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < d.DeleteWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				path := filepath.Join(d.dir, d.sub[i].path())
+				if err := d.ignore(removeOne(wctx, path, d.sub[i])); err != nil {
+					errs[i] = err
+					if !d.DeleteKeepGoing {
+						cancel()
+					}
+					continue
+				}
+				if !d.DryRun {
+					d.mu.Lock()
+					d.removed++
+					removed = append(removed, path)
+					d.mu.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range d.sub {
+		select {
+		case ch <- i:
+		case <-wctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// In the order of d.sub regardless of the workers, leaving out those
+	// stopped because of another.
+	var failed []error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			failed = append(failed, err)
+		}
+	}
+	endDelete()
+	endPrune := d.phase("empty dirs")
+	if err := d.ignore(d.removeEmptyParents(d.dir, removed)); err != nil {
+		failed = append(failed, err)
+	}
+	endPrune()
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+	if d.trashing() && !d.DryRun {
+		if err := d.rotateTrash(d.trashOf(d.dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies d.add to d.dir with --copier, recording the copied files in rl
+// if it isn't nil.
+func (d *destination) copy(ctx context.Context, rl *resumeLog) (err error) {
+	pw := d.newProgressWriter(os.Stdout, d.add)
+	if rl != nil {
+		pw.done = rl.done
+	}
+	d.setCopying(pw)
+	if d.Progress && d.ETAInterval > 0 && !d.DryRun {
+		defer pw.startETA(d.ETAInterval)()
+	}
+	defer func() {
+		d.copied = pw.files
+		if err == nil {
+			pw.finish()
+		}
+	}()
+	if d.Copier == "native" || d.LinkOnly {
+		return d.copyNative(ctx, pw)
+	}
+	file, err := os.CreateTemp("", "*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	for _, f := range d.add {
+		fmt.Fprintln(file, f.path())
+		if d.DryRun {
+			report("copy", fmt.Sprintf("would copy %s", f.path()), "path", f.path(), "size", f.size, "dry_run", true)
+		}
+	}
+	stderr := &stderrScanner{w: os.Stderr}
+	args := d.rsyncArgs(file.Name(), d.dir)
+	if d.DryRun {
+		args = append([]string{d.RsyncPath}, args...)
+		report("rsync", strings.Join(args, " "), "args", args, "dry_run", true)
+		return nil
+	}
+	// rsync skips what it copied already when run again.
+	start := time.Now()
+	err = d.retry(ctx, "rsync", func() error {
+		slog.Debug(d.RsyncPath + " " + strings.Join(args, " "))
+		return d.rsync.run(ctx, d.RsyncPath, args, pw, stderr)
+	})
+	elapsed := time.Since(start)
+	if ctx.Err() == nil {
+		d.dropVanished(stderr.vanished)
+	}
+	if err != nil && stderr.noSpace && ctx.Err() == nil {
+		d.rsyncOutOfSpace(pw, err)
+		return nil
+	}
+	if err := d.acceptExit(err); err != nil {
+		return err
+	}
+	d.reportThroughput(pw, elapsed)
+	return nil
+}
+
+// sync deletes d.sub from and copies d.add to d.dir. It returns the copied
+// files which failed verification.
+//
+// By default the deletion comes first so that the copy can use the space it
+// frees, which matters when dst is close to full. With --copy-before-delete
+// nothing is deleted unless the copy (and the verification, if enabled)
+// succeeded, at the cost of temporarily needing room for both.
+func (d *destination) sync(ctx context.Context) ([]string, error) {
+	var rl *resumeLog
+	if !d.DryRun {
+		var err error
+		if rl, err = d.writePlan(d); err != nil {
+			return nil, err
+		}
+		defer rl.Close()
+	}
+	// Before anything is removed, which the moved files would have been.
+	if err := d.reuse(ctx); err != nil {
+		return nil, err
+	}
+	if !d.CopyBeforeDelete {
+		if err := d.remove(ctx); err != nil {
+			return nil, err
+		}
+	}
+	copyStart := time.Now()
+	endCopy := d.phase("copy")
+	if err := d.copy(ctx, rl); err != nil {
+		return nil, err
+	}
+	if err := d.link(ctx); err != nil {
+		return nil, err
+	}
+	copyTime := time.Since(copyStart)
+	endCopy()
+	var failed []string
+	if d.Verify && !d.DryRun {
+		var err error
+		endVerify := d.phase("verify")
+		if failed, err = d.verifyFiles(ctx, d.dir, d.add); err != nil {
+			return nil, err
+		}
+		endVerify()
+	}
+	if d.CopyBeforeDelete {
+		if len(failed) > 0 {
+			log.Printf("Not deleting anything from %s since some copies failed verification\n", d.dir)
+			d.sub = nil
+		} else if d.noSpace != nil {
+			log.Printf("Not deleting anything from %s since it ran out of space\n", d.dir)
+			d.sub = nil
+		} else if err := d.remove(ctx); err != nil {
+			return nil, err
+		}
+	}
+	// rsync takes care of the directories on a remote dst, and those of
+	// src aren't there with --flatten or --organize-by. With several --src,
+	// each root's are under its label.
+	if !isRemote(d.dir) && !d.Flatten && d.OrganizeBy == "" {
+		endAttrs := d.phase("dir attributes")
+		if len(d.ExtraSrc) == 0 {
+			if err := d.updateDirAttributes(d.Src, d.dir); err != nil {
+				return nil, err
+			}
+		} else {
+			for _, root := range d.srcRoots() {
+				if err := d.updateDirAttributes(root, filepath.Join(d.dir, srcLabel(root))); err != nil {
+					return nil, err
+				}
+			}
+		}
+		endAttrs()
+	}
+
+	if !d.DryRun {
+		if err := d.writeManifestOf(ctx, d.dir, d.newManifest(d)); err != nil {
+			return nil, err
+		}
+		if err := d.clearPlan(d.dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.DryRun {
+		summary("summary", fmt.Sprintf("dry run: would add %d files (%s) to %s, remove %d files (%s)",
+			len(d.add), d.formatSize(totalSize(d.add)), d.dir, len(d.sub), d.formatSize(totalSize(d.sub))),
+			"dst", d.dir, "added", len(d.add), "added_size", totalSize(d.add),
+			"removed", len(d.sub), "removed_size", totalSize(d.sub), "dry_run", true)
+	} else if d.Progress {
+		summary("summary", fmt.Sprintf("Added %d files (%s) to %s in %s at %s, removed %d files (%s)",
+			len(d.add), d.formatSize(totalSize(d.add)), d.dir, copyTime.Round(time.Second), d.rate(totalSize(d.add), copyTime),
+			len(d.sub), d.formatSize(totalSize(d.sub))),
+			"dst", d.dir, "added", len(d.add), "added_size", totalSize(d.add),
+			"removed", len(d.sub), "removed_size", totalSize(d.sub), "copy_time", copyTime)
+	}
+	d.reportRetries()
+	return failed, nil
+}
+
+// Summary is what a Run did.
+type Summary struct {
+	// Added and Removed count the files copied to and removed from the
+	// destinations, and Bytes is the size of the copied ones. With DryRun
+	// they are what would have been.
+	Added, Removed int
+	Bytes          int64
+	// LinkOnly is set when the files were linked rather than copied, with
+	// --link-only, so that Bytes and the budget are only informational.
+	LinkOnly bool
+	// Skipped counts the src files which didn't fit, and Pruned the ones of
+	// them deleted by --prune-src-older.
+	Skipped, Pruned int
+	// Cutoff is the mtime of the oldest file kept in the destinations, the
+	// date down to which they hold src, and NewestSkipped the mtime of the
+	// newest file which didn't fit. Both are zero if everything fits or
+	// nothing does.
+	Cutoff, NewestSkipped time.Time
+	// VerifyFailed lists the copies which failed --verify, with why.
+	VerifyFailed []string
+	// Errors lists the errors carried on after with --ignore-errors.
+	Errors   []string
+	Duration time.Duration
+}
+
+// String formats s as one line, e.g. for printing at the end of a run.
+func (s Summary) String() string {
+	var b strings.Builder
+	if s.LinkOnly {
+		fmt.Fprintf(&b, "linked %d files (%s in src, taking no space), removed %d files", s.Added, humanize(s.Bytes), s.Removed)
+	} else {
+		fmt.Fprintf(&b, "added %d files (%s), removed %d files", s.Added, humanize(s.Bytes), s.Removed)
+	}
+	if s.Skipped > 0 {
+		fmt.Fprintf(&b, ", left out %d files", s.Skipped)
+	}
+	if !s.Cutoff.IsZero() {
+		fmt.Fprintf(&b, ", keeping files down to %s", s.Cutoff.Format(time.DateTime))
+	}
+	if s.Pruned > 0 {
+		fmt.Fprintf(&b, ", deleted %d old files from src", s.Pruned)
+	}
+	if len(s.VerifyFailed) > 0 {
+		fmt.Fprintf(&b, ", %d failed verification", len(s.VerifyFailed))
+	}
+	if len(s.Errors) > 0 {
+		fmt.Fprintf(&b, ", %d errors", len(s.Errors))
+	}
+	fmt.Fprintf(&b, " in %s", s.Duration.Round(time.Second))
+	return b.String()
+}
+
+// Run does what cfg says, logging through slog.Default(). It stops early when
+// ctx is done, returning ctx.Err() wrapped.
+func Run(ctx context.Context, cfg Config) (Summary, error) {
+	return newRunner(cfg).runAll(ctx)
+}
+
+// runAll is Run with r, which tests can give a stand-in for rsync first.
+func (r *runner) runAll(ctx context.Context) (s Summary, err error) {
+	if r.SummaryJSON != "" {
+		// However the run ends, for monitoring.
+		defer func() {
+			if werr := writeSummary(r.SummaryJSON, s, r.DryRun, err); err == nil {
+				err = werr
+			}
+		}()
+	}
+	if err := r.loadPatterns(); err != nil {
+		return Summary{}, err
+	}
+	if err := r.check(); err != nil {
+		return Summary{}, err
+	}
+	if r.ChecksumDB != "" {
+		db, err := openChecksumDB(r.ChecksumDB, r.ManifestCompression)
+		if err != nil {
+			return Summary{}, err
+		}
+		r.checksums = db
+	}
+	start := time.Now()
+	r.status.start = start
+	if r.Status != nil {
+		defer r.watchStatus()()
+	}
+	r.summary.LinkOnly = r.LinkOnly
+	err = r.run(ctx)
+	if ierr := r.ignoredErrors(); err == nil {
+		err = ierr
+	}
+	r.summary.Duration = time.Since(start)
+	if r.Timing {
+		r.reportTiming(r.summary.Duration)
+	}
+	if r.checksums != nil {
+		if serr := r.checksums.save(); err == nil {
+			err = serr
+		}
+	}
+	return r.summary, err
+}
+
+// within reports whether path is dir or under it. Both are made absolute and
+// symlinks in them resolved, as far as they exist.
+func within(path, dir string) (bool, error) {
+	resolve := func(p string) (string, error) {
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			p = r
+		}
+		return p, nil
+	}
+	path, err := resolve(path)
+	if err != nil {
+		return false, err
+	}
+	dir, err = resolve(dir)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// checkNesting makes sure that none of src and the destinations is in
+// another, which would have a run scan its own copies or delete src files.
+func (r *runner) checkNesting() error {
+	dirs := append(r.srcRoots(), r.Dst...)
+	name := func(i int) string {
+		if i <= len(r.ExtraSrc) {
+			return "--src " + dirs[i]
+		}
+		return "--dst " + dirs[i]
+	}
+	for i, a := range dirs {
+		if isRemote(a) {
+			continue
+		}
+		for j, b := range dirs {
+			if i == j || isRemote(b) {
+				continue
+			}
+			in, err := within(a, b)
+			if err != nil {
+				return err
+			}
+			if !in {
+				continue
+			}
+			if same, _ := within(b, a); same {
+				if i < j {
+					return fmt.Errorf("%s and %s are the same directory", name(i), name(j))
+				}
+				continue
+			}
+			return fmt.Errorf("%s is inside %s", name(i), name(j))
+		}
+	}
+	return nil
+}
+
+func (r *runner) run(ctx context.Context) error {
+	start := time.Now()
+	// Before anything, the lock included, is written to a dst.
+	if err := r.checkMounts(); err != nil {
+		return err
+	}
+	if !r.reportOnly() {
+		if err := r.checkNesting(); err != nil {
+			return err
+		}
+		if !r.DryRun {
+			unlock, err := r.lockDsts(ctx)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+		}
+	}
+	// Better fail now than after deleting files.
+	if r.Copier == "rsync" && !r.LinkOnly && !r.DryRun && !r.reportOnly() {
+		if err := r.rsync.find(r.RsyncPath); err != nil {
+			return err
+		}
+	}
+	if r.PreHook != "" {
+		if err := r.runHook(ctx, "pre-hook", r.PreHook); err != nil {
+			return err
+		}
+	}
+	if r.Resume && !r.reportOnly() {
+		dests, err := r.resumeDestinations(ctx)
+		if err != nil {
+			return err
+		}
+		if dests != nil {
+			return r.syncAll(ctx, start, dests, nil)
+		}
+		log.Printf("No incomplete run to resume, planning from scratch\n")
+	}
+	opts := r.srcScanOptions()
+	// The files stored by the last run with --since-last-run.
+	var previous []*file
+	incremental := false
+	if r.SinceLastRun && !r.Full && !r.reportOnly() {
+		since, kept, err := r.lastRun(ctx)
+		if err != nil {
+			return err
+		}
+		if !since.IsZero() {
+			log.Printf("Only scanning the src files modified since the last run at %s\n", since.Format(time.DateTime))
+			// Less --min-age, as what was too recent for the last run is due
+			// now.
+			since = since.Add(-r.MinAge)
+			if since.After(opts.after) {
+				opts.after = since
+			}
+			previous, incremental = kept, true
+		}
+	}
+	endScan := r.phase("src scan")
+	files, err := r.scanSrc(ctx, opts)
+	endScan()
+	if err != nil {
+		return err
+	}
+	if r.ReportDuplicates {
+		return r.duplicates(files, r.HashDuplicates)
+	}
+	if r.ByExtension {
+		r.reportExtensions("library", files)
+	}
+	if r.AccountBlocksize {
+		if err := r.detectBlockSize(); err != nil {
+			return err
+		}
+	}
+	if r.StatOnly {
+		return r.printStats(ctx, files)
+	}
+	if r.Dedup {
+		if err := r.hashDuplicateCandidates(ctx, files); err != nil {
+			return err
+		}
+	}
+	switch {
+	case r.Flatten:
+		files = flatten(files)
+	case r.OrganizeBy == "exif-date":
+		files = organizeByDate(files)
+	}
+	if r.DiffManifest != "" {
+		return r.diffManifest(files)
+	}
+	if r.ReportCoverage {
+		return r.reportCoverage(ctx, files)
+	}
+	var dests []*destination
+	var budget int64
+	for _, dir := range r.Dst {
+		d, err := r.newDestination(ctx, dir)
+		if err != nil {
+			return err
+		}
+		dests = append(dests, d)
+		budget += d.budget
+		if !r.Resume {
+			p, _, err := r.readPlan(dir)
+			if err != nil {
+				return err
+			}
+			if p != nil {
+				log.Printf("The run of %s to %s was interrupted, use --resume to carry on with it\n", p.Time.Format(time.DateTime), dir)
+			}
+		}
+		// Only a full scan tells what is gone from src.
+		if d.manifest != nil && !incremental {
+			deleted := deletedFromSrc(d.manifest, files)
+			for _, e := range deleted {
+				report("deleted-from-src", fmt.Sprintf("deleted from src since %s: %s", d.manifest.Time.Format(time.DateTime), e.Path),
+					"path", e.Path, "size", e.Size, "dst", dir)
+			}
+			if len(deleted) > 0 {
+				log.Printf("%d files in %s were deleted from src since the last run\n", len(deleted), dir)
+			}
+		}
+	}
+	if incremental {
+		stored := stillStored(previous, files, dests)
+		log.Printf("%d new or modified src files, %d stored by the last run\n", len(files), len(stored))
+		files = append(files, stored...)
+	}
+	if r.Transcode != "" {
+		r.estimateTranscoded(files, dests)
+	}
+	endSelect := r.phase("select")
+	var present []*file
+	if r.keeping() {
+		// Nothing leaves dst, so whatever is there already is kept regardless
+		// of recency and only the rest of the budget goes to new files.
+		present, files = r.retain(files, dests)
+		budget -= r.allocatedSize(present)
+		for _, d := range dests {
+			budget -= d.used
+		}
+	}
+	var selected, skipped []*file
+	if r.BalanceDirs != "" {
+		selected, skipped, err = r.balanceDirs(files, budget)
+	} else {
+		selected, skipped, err = r.mostRecent(files, budget)
+	}
+	if err != nil {
+		return err
+	}
+	r.summary.Skipped = len(skipped)
+	r.summary.NewestSkipped = newest(skipped)
+	if r.ReportSkipped {
+		r.reportSkipped(skipped)
+	}
+	if r.ByExtension {
+		r.reportExtensions("kept", append(slices.Clone(present), selected...))
+	}
+	r.place(append(present, selected...), dests)
+	endSelect()
+	endCompare := r.phase("compare")
+	for _, d := range dests {
+		d.add, d.sub = r.compare(d.keep, d.files, d.fat, d.fold)
+		if r.Checksum {
+			if err := d.dropIdentical(ctx); err != nil {
+				return err
+			}
+		}
+		if r.DedupeAcrossSrcDst {
+			if err := d.planReuse(ctx); err != nil {
+				return err
+			}
+		}
+		if r.Dedup {
+			if err := d.planLinks(); err != nil {
+				return err
+			}
+		}
+		if r.MinFreeAfter > 0 && !r.LinkOnly {
+			if err := d.checkFree(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	endCompare()
+	return r.syncAll(ctx, start, dests, skipped)
+}
+
+// resumeDestinations returns the destinations set up to carry on with their
+// interrupted runs, or nil unless all of them have one.
+func (r *runner) resumeDestinations(ctx context.Context) ([]*destination, error) {
+	var dests []*destination
+	for _, dir := range r.Dst {
+		p, done, err := r.readPlan(dir)
+		if err != nil || p == nil {
+			return nil, err
+		}
+		d, err := r.newDestination(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		d.resumeFrom(p, done)
+		dests = append(dests, d)
+	}
+	return dests, nil
+}
+
+// syncAll syncs dests in turn, then prunes skipped from src.
+func (r *runner) syncAll(ctx context.Context, start time.Time, dests []*destination, skipped []*file) error {
+	if r.TreePreview {
+		for _, d := range dests {
+			d.treePreview()
+		}
+	}
+	if err := r.confirm(dests); err != nil {
+		return err
+	}
+	var failed []string
+	var added int
+	defer r.setSyncing(nil)
+	for _, d := range dests {
+		r.setSyncing(d)
+		f, err := d.sync(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				for _, d := range dests {
+					summary("interrupted", fmt.Sprintf("Interrupted: removed %d of %d and copied %d of %d files in %s",
+						d.removed, len(d.sub), d.copied, len(d.add), d.dir),
+						"dst", d.dir, "removed", d.removed, "to_remove", len(d.sub), "copied", d.copied, "to_copy", len(d.add))
+				}
+			}
+			return err
+		}
+		failed = append(failed, f...)
+		added += len(d.add)
+		r.status.mu.Lock()
+		r.summary.Added += len(d.add)
+		r.summary.Bytes += totalSize(d.add)
+		if r.DryRun {
+			if !r.keeping() {
+				r.summary.Removed += len(d.sub)
+			}
+		} else {
+			r.summary.Removed += d.removed
+		}
+		r.status.mu.Unlock()
+		if c := oldest(d.keep); !c.IsZero() && (r.summary.Cutoff.IsZero() || c.Before(r.summary.Cutoff)) {
+			r.summary.Cutoff = c
+		}
+	}
+	if r.summary.Skipped == 0 || r.summary.Cutoff.IsZero() {
+		// Nothing is cut off.
+		r.summary.Cutoff, r.summary.NewestSkipped = time.Time{}, time.Time{}
+	}
+	r.summary.VerifyFailed = failed
+	if r.Progress && !r.DryRun {
+		summary("total-time", fmt.Sprintf("Total time %s", time.Since(start).Round(time.Second)), "duration", time.Since(start))
+	}
+	if len(failed) > 0 {
+		for _, f := range failed {
+			summary("verify-fail", fmt.Sprintf("verify failed: %s", f), "path", f)
+		}
+		return fmt.Errorf("%d of %d copied files failed verification", len(failed), added)
+	}
+	var noSpace []error
+	for _, d := range dests {
+		if d.noSpace != nil {
+			noSpace = append(noSpace, d.noSpace)
+		}
+	}
+	if len(noSpace) > 0 {
+		return errors.Join(noSpace...)
+	}
+	if r.PruneSrcOlder > 0 {
+		if err := r.pruneSrc(ctx, skipped); err != nil {
+			return err
+		}
 	}
+	return r.runPostHook(ctx)
 }
@@ -0,0 +1,2363 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// base is the mtime the fixtures are relative to.
+var base = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// entry describes a file of a fixture tree.
+type entry struct {
+	path string // slash separated, relative to the root
+	size int64
+	age  time.Duration // before base
+}
+
+// makeTree creates the files described by entries in a new temporary
+// directory and returns it.
+func makeTree(t testing.TB, entries ...entry) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, e := range entries {
+		path := filepath.Join(root, filepath.FromSlash(e.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(e.size); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		mtime := base.Add(-e.age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// testRunner returns a runner of the default Config.
+func testRunner() *runner {
+	return newRunner(DefaultConfig())
+}
+
+// newFile returns a file at the slash separated path as scan would.
+func newFile(path string, size int64, age time.Duration) *file {
+	rel := filepath.FromSlash(path)
+	mtime := base.Add(-age)
+	return &file{dir: filepath.Dir(rel), base: filepath.Base(rel), size: size, modTime: mtime, captureTime: mtime}
+}
+
+// quietLogs discards what the test logs, restoring slog.Default() after it.
+func quietLogs(t testing.TB) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// captureLogs collects what the test logs as JSON records, one per line.
+func captureLogs(t testing.TB) *strings.Builder {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	out := new(strings.Builder)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(out, nil)))
+	return out
+}
+
+// testConfig returns the default Config copying src to dst with the native
+// copier, with the logs of the test discarded.
+func testConfig(t testing.TB, src, dst string) Config {
+	quietLogs(t)
+	cfg := DefaultConfig()
+	cfg.Src, cfg.Dst = src, []string{dst}
+	cfg.Copier = "native"
+	return cfg
+}
+
+// paths returns the slash separated paths of files.
+func paths(files []*file) []string {
+	var ps []string
+	for _, f := range files {
+		ps = append(ps, manifestPath(f))
+	}
+	return ps
+}
+
+func TestScan(t *testing.T) {
+	root := makeTree(t,
+		entry{"b/y.jpg", 20, time.Hour},
+		entry{"a/x.jpg", 10, 2 * time.Hour},
+		entry{"z.jpg", 30, 0},
+		entry{manifestName, 5, 0},
+		entry{trashName + "/old.jpg", 40, 0},
+	)
+	files, err := scan(context.Background(), root, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"a/x.jpg", "b/y.jpg", "z.jpg"}; !slices.Equal(got, want) {
+		t.Fatalf("scan() = %q, want %q", got, want)
+	}
+	for i, want := range []struct {
+		size  int64
+		mtime time.Time
+	}{
+		{10, base.Add(-2 * time.Hour)},
+		{20, base.Add(-time.Hour)},
+		{30, base},
+	} {
+		if f := files[i]; f.size != want.size || !f.modTime.Equal(want.mtime) {
+			t.Errorf("%s: size %d, mtime %s, want %d, %s", f.path(), f.size, f.modTime, want.size, want.mtime)
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	var entries []entry
+	for i := 0; i < 4000; i++ {
+		entries = append(entries, entry{fmt.Sprintf("%02d/%03d/%d.jpg", i%20, i%200, i), 0, 0})
+	}
+	root := makeTree(b, entries...)
+	for _, workers := range slices.Compact([]int{1, runtime.GOMAXPROCS(0)}) {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := scan(context.Background(), root, scanOptions{workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestScanRoots(t *testing.T) {
+	root := makeTree(t,
+		entry{"a/x.jpg", 1, 0},
+		entry{"y.jpg", 1, 0},
+	)
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{root, root + string(filepath.Separator), link, link + string(filepath.Separator)} {
+		files, err := scan(context.Background(), dir, scanOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := paths(files), []string{"a/x.jpg", "y.jpg"}; !slices.Equal(got, want) {
+			t.Errorf("scan(%q) = %q, want %q", dir, got, want)
+		}
+	}
+}
+
+func TestScanSystemFiles(t *testing.T) {
+	root := makeTree(t,
+		entry{"a/x.jpg", 1, 0},
+		entry{"a/._x.jpg", 1, 0},
+		entry{".DS_Store", 1, 0},
+		entry{"b/Thumbs.db", 1, 0},
+		entry{".git/config", 1, 0},
+		entry{"c/@eaDir/x.jpg", 1, 0},
+	)
+	for _, tc := range []struct {
+		skip bool
+		want []string
+	}{
+		{true, []string{"a/x.jpg"}},
+		{false, []string{".DS_Store", ".git/config", "a/._x.jpg", "a/x.jpg", "b/Thumbs.db", "c/@eaDir/x.jpg"}},
+	} {
+		r := testRunner()
+		r.SkipSystemFiles = tc.skip
+		files, err := scan(context.Background(), root, r.srcScanOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(files); !slices.Equal(got, tc.want) {
+			t.Errorf("scan() with --skip-system-files=%v = %q, want %q", tc.skip, got, tc.want)
+		}
+	}
+}
+
+func TestScanProtect(t *testing.T) {
+	root := makeTree(t,
+		entry{"a/x.jpg", 1, 0},
+		entry{"a/.thumbnails/x.png", 1, 0},
+		entry{".thumbnails/y.png", 1, 0},
+		entry{"b/notes.txt", 1, 0},
+	)
+	files, err := scan(context.Background(), root, scanOptions{protect: append(DefaultConfig().DstProtect, "notes.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"a/x.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("scan() = %q, want %q", got, want)
+	}
+}
+
+func TestScanOneFileSystem(t *testing.T) {
+	root := makeTree(t, entry{"a/x.jpg", 1, 0})
+	other, err := os.MkdirTemp("/dev/shm", "catalog")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(other)
+	// The symlink stands in for a mount point.
+	if onSameDevice(other, root) {
+		t.Skip("/dev/shm is on the same file system as the temporary directory")
+	}
+	if err := os.WriteFile(filepath.Join(other, "y.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(other, filepath.Join(root, "mnt")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := scan(context.Background(), root, scanOptions{followSymlinks: true, oneFileSystem: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"a/x.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("scan() = %q, want %q", got, want)
+	}
+}
+
+func TestScanLinks(t *testing.T) {
+	root := makeTree(t, entry{"2024/a.jpg", 10, 0})
+	outside := makeTree(t, entry{"b.jpg", 20, 0})
+	for link, target := range map[string]string{
+		"latest.jpg":   filepath.Join("2024", "a.jpg"),
+		"abs.jpg":      filepath.Join(root, "2024", "a.jpg"),
+		"outside.jpg":  filepath.Join(outside, "b.jpg"),
+		"broken.jpg":   "nowhere.jpg",
+		"2024/dir.jpg": ".",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quietLogs(t)
+
+	files, err := scan(context.Background(), root, scanOptions{links: "copy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		sizes[filepath.ToSlash(f.path())] = f.size
+	}
+	if want := map[string]int64{"2024/a.jpg": 10, "abs.jpg": 10, "latest.jpg": 10, "outside.jpg": 20}; !maps.Equal(sizes, want) {
+		t.Errorf("copy: sizes = %v, want %v", sizes, want)
+	}
+
+	files, err = scan(context.Background(), root, scanOptions{links: "preserve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]string)
+	for _, f := range files {
+		links[filepath.ToSlash(f.path())] = f.link
+	}
+	want := map[string]string{
+		"2024/a.jpg":  "",
+		"abs.jpg":     filepath.Join("2024", "a.jpg"),
+		"latest.jpg":  filepath.Join("2024", "a.jpg"),
+		"outside.jpg": filepath.Join(outside, "b.jpg"),
+	}
+	if !maps.Equal(links, want) {
+		t.Errorf("preserve: links = %q, want %q", links, want)
+	}
+}
+
+func TestRunLinksWarning(t *testing.T) {
+	src := makeTree(t, entry{"a.jpg", 10, 0}, entry{"b.jpg", 10, 0})
+	for _, name := range []string{"latest.jpg", "other.jpg"} {
+		if err := os.Symlink("a.jpg", filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for links, want := range map[string]int{"": 1, "copy": 0} {
+		cfg := testConfig(t, src, t.TempDir())
+		cfg.Copier = "rsync"
+		cfg.Links = links
+		out := captureLogs(t)
+		r := newRunner(cfg)
+		r.rsync = &fakeRsync{}
+		if _, err := r.runAll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(out.String(), "--links=preserve"); got != want {
+			t.Errorf("--links=%q: warned %d times, want %d", links, got, want)
+		}
+		if !slices.Contains(r.rsyncArgs("list", "/dst"), "--copy-links") {
+			t.Errorf("--links=%q: rsync doesn't get --copy-links", links)
+		}
+	}
+}
+
+func TestScanMinAge(t *testing.T) {
+	root := makeTree(t, entry{"old.jpg", 1, 0}, entry{"landing.jpg", 1, 0})
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(root, "landing.jpg"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	r := testRunner()
+	r.MinAge = time.Minute
+	files, err := scan(context.Background(), root, r.srcScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"old.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("scan() = %q, want %q", got, want)
+	}
+}
+
+func TestScanMaxDepth(t *testing.T) {
+	root := makeTree(t,
+		entry{"top.jpg", 1, 0},
+		entry{"a/x.jpg", 1, 0},
+		entry{"a/export/y.jpg", 1, 0},
+		entry{"a/export/deeper/z.jpg", 1, 0},
+	)
+	for depth, want := range map[int][]string{
+		-1: {"a/export/deeper/z.jpg", "a/export/y.jpg", "a/x.jpg", "top.jpg"},
+		0:  {"top.jpg"},
+		1:  {"a/x.jpg", "top.jpg"},
+		2:  {"a/export/y.jpg", "a/x.jpg", "top.jpg"},
+	} {
+		r := testRunner()
+		r.MaxDepth = depth
+		files, err := scan(context.Background(), root, r.srcScanOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := paths(files)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("scan() with --max-depth=%d = %q, want %q", depth, got, want)
+		}
+	}
+}
+
+func TestScanSize(t *testing.T) {
+	root := makeTree(t,
+		entry{"empty.jpg", 0, 0},
+		entry{"min.jpg", 10, 0},
+		entry{"max.jpg", 100, 0},
+		entry{"huge.tif", 101, 0},
+	)
+	for _, tc := range []struct {
+		min, max int64
+		want     []string
+	}{
+		{0, 0, []string{"empty.jpg", "huge.tif", "max.jpg", "min.jpg"}},
+		{10, 100, []string{"max.jpg", "min.jpg"}},
+		{1, 0, []string{"huge.tif", "max.jpg", "min.jpg"}},
+	} {
+		files, err := scan(context.Background(), root, scanOptions{minSize: tc.min, maxSize: tc.max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(files); !slices.Equal(got, tc.want) {
+			t.Errorf("scan() with --min-size=%d --max-size=%d = %q, want %q", tc.min, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestScanList(t *testing.T) {
+	root := makeTree(t,
+		entry{"a/x.jpg", 1, 0},
+		entry{"a/y.jpg", 2, 0},
+		entry{"b/z.jpg", 3, 0},
+	)
+	list := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(list, []byte("b/z.jpg\nmissing.jpg\n\na/x.jpg\n../a/x.jpg\na\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := scan(context.Background(), root, scanOptions{list: list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"a/x.jpg", "b/z.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("scan() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadPatterns(t *testing.T) {
+	dir := t.TempDir()
+	exclude := filepath.Join(dir, "exclude")
+	if err := os.WriteFile(exclude, []byte("# camera junk\n*.THM\n\n  *.LRV  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inline := []string{"*.tmp"}
+	r := testRunner()
+	r.Exclude, r.ExcludeFrom = inline, exclude
+	if err := r.loadPatterns(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.tmp", "*.THM", "*.LRV"}; !slices.Equal(r.Exclude, want) {
+		t.Errorf("Exclude = %q, want %q", r.Exclude, want)
+	}
+
+	bad := filepath.Join(dir, "bad")
+	if err := os.WriteFile(bad, []byte("*.jpg\n[a-\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r = testRunner()
+	r.IncludeFrom = bad
+	if err := r.loadPatterns(); err == nil || !strings.Contains(err.Error(), bad+":2:") {
+		t.Errorf("loadPatterns() = %v, want an error about line 2", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	src := []*file{
+		newFile("a.jpg", 1, 0),
+		newFile("b/c.jpg", 1, 0),
+		newFile("d.jpg", 1, 0),
+		newFile("resized.jpg", 2, time.Hour),
+		newFile("edited.jpg", 1, 0),
+		newFile("rounded.jpg", 1, 0),
+		newFile("older.jpg", 1, time.Hour),
+	}
+	dst := []*file{
+		newFile("b/c.jpg", 1, 0),
+		newFile("e.jpg", 1, 0),
+		newFile("resized.jpg", 1, time.Hour),
+		newFile("edited.jpg", 1, time.Minute),
+		newFile("rounded.jpg", 1, time.Second),
+		newFile("older.jpg", 1, 0),
+	}
+	add, sub := testRunner().compare(src, dst, true, false)
+	if got, want := paths(add), []string{"a.jpg", "d.jpg", "resized.jpg", "edited.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("add = %q, want %q", got, want)
+	}
+	if got, want := paths(sub), []string{"e.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("sub = %q, want %q", got, want)
+	}
+}
+
+func TestCompareOverwritePolicy(t *testing.T) {
+	src := []*file{
+		newFile("same.jpg", 1, time.Hour),
+		newFile("newer.jpg", 1, 0),
+		newFile("resized.jpg", 2, time.Hour),
+		newFile("older.jpg", 2, 2*time.Hour),
+		newFile("new.jpg", 1, 0),
+	}
+	dst := []*file{
+		newFile("same.jpg", 1, time.Hour),
+		newFile("newer.jpg", 1, time.Hour),
+		newFile("resized.jpg", 1, time.Hour),
+		newFile("older.jpg", 1, time.Hour),
+	}
+	for policy, want := range map[string][]string{
+		"changed": {"newer.jpg", "resized.jpg", "older.jpg", "new.jpg"},
+		"always":  {"same.jpg", "newer.jpg", "resized.jpg", "older.jpg", "new.jpg"},
+		"newer":   {"newer.jpg", "new.jpg"},
+		"size":    {"resized.jpg", "older.jpg", "new.jpg"},
+		"never":   {"new.jpg"},
+	} {
+		r := testRunner()
+		r.OverwritePolicy = policy
+		if add, _ := r.compare(src, dst, false, false); !slices.Equal(paths(add), want) {
+			t.Errorf("add = %q with --overwrite-policy=%s, want %q", paths(add), policy, want)
+		}
+	}
+}
+
+func TestCompareUpdate(t *testing.T) {
+	src := []*file{
+		newFile("edited.jpg", 10, 0),
+		newFile("touched.jpg", 10, 0),
+		newFile("fat.jpg", 10, 0),
+		newFile("restored.jpg", 10, time.Hour),
+	}
+	dst := []*file{
+		// The same size, so only the mtime tells them apart.
+		newFile("edited.jpg", 10, time.Hour),
+		newFile("touched.jpg", 10, time.Second/2),
+		newFile("fat.jpg", 10, 2*time.Second),
+		// Newer on dst, which the default policy overwrites for the size.
+		newFile("restored.jpg", 20, 0),
+	}
+	r := testRunner()
+	r.OverwritePolicy = "newer"
+	if add, _ := r.compare(src, dst, false, false); !slices.Equal(paths(add), []string{"edited.jpg", "fat.jpg"}) {
+		t.Errorf("add = %q, want edited.jpg and fat.jpg", paths(add))
+	}
+	// Within the 2s of FAT mtimes.
+	if add, _ := r.compare(src, dst, true, false); !slices.Equal(paths(add), []string{"edited.jpg"}) {
+		t.Errorf("add = %q on FAT, want edited.jpg", paths(add))
+	}
+}
+
+func TestCompareCaseInsensitive(t *testing.T) {
+	src := []*file{
+		newFile("DCIM/IMG_0001.JPG", 1, 0),
+		newFile("DCIM/IMG_0002.JPG", 2, 0),
+	}
+	dst := []*file{
+		newFile("dcim/img_0001.jpg", 1, 0),
+		newFile("dcim/img_0002.jpg", 1, 0),
+		newFile("dcim/img_0003.jpg", 1, 0),
+	}
+	add, sub := testRunner().compare(src, dst, false, true)
+	if got, want := paths(add), []string{"DCIM/IMG_0002.JPG"}; !slices.Equal(got, want) {
+		t.Errorf("add = %q, want %q", got, want)
+	}
+	// Deleted under its name on dst.
+	if got, want := paths(sub), []string{"dcim/img_0003.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("sub = %q, want %q", got, want)
+	}
+
+	r := testRunner()
+	r.CaseInsensitive = true
+	if add, _ := r.compare(src, dst, false, false); len(add) != 1 {
+		t.Errorf("add = %q with --case-insensitive, want 1 file", paths(add))
+	}
+	if add, _ := testRunner().compare(src, dst, false, false); len(add) != 2 {
+		t.Errorf("add = %q case sensitively, want 2 files", paths(add))
+	}
+}
+
+func TestMostRecent(t *testing.T) {
+	files := func() []*file {
+		return []*file{
+			newFile("old.jpg", 30, 3*time.Hour),
+			newFile("new.jpg", 40, time.Hour),
+			newFile("small.jpg", 5, 4*time.Hour),
+			newFile("newest.jpg", 25, 0),
+		}
+	}
+	for _, tc := range []struct {
+		name     string
+		budget   int64
+		pack     bool
+		maxFiles int
+		kept     []string
+	}{
+		{"everything", 100, false, 0, []string{"newest.jpg", "new.jpg", "old.jpg", "small.jpg"}},
+		{"exact fit", 95, false, 0, []string{"newest.jpg", "new.jpg", "old.jpg"}},
+		{"one byte short", 94, false, 0, []string{"newest.jpg", "new.jpg"}},
+		{"nothing", 10, false, 0, nil},
+		{"pack", 75, true, 0, []string{"newest.jpg", "new.jpg", "small.jpg"}},
+		{"max files", 100, false, 2, []string{"newest.jpg", "new.jpg"}},
+		{"budget before max files", 94, false, 3, []string{"newest.jpg", "new.jpg"}},
+		{"pack up to max files", 75, true, 2, []string{"newest.jpg", "new.jpg"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := testRunner()
+			r.Pack = tc.pack
+			r.MaxFiles = tc.maxFiles
+			kept, skipped, err := r.mostRecent(files(), tc.budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := paths(kept); !slices.Equal(got, tc.kept) {
+				t.Errorf("kept = %q, want %q", got, tc.kept)
+			}
+			if got, want := len(kept)+len(skipped), 4; got != want {
+				t.Errorf("%d kept and skipped, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMostRecentSortBySize(t *testing.T) {
+	r := testRunner()
+	r.SortBy = "size"
+	files := []*file{
+		newFile("video.mp4", 60, 0),
+		newFile("old.jpg", 20, 2*time.Hour),
+		newFile("new.jpg", 20, time.Hour),
+		newFile("tiny.jpg", 5, 3*time.Hour),
+	}
+	kept, _, err := r.mostRecent(files, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(kept), []string{"tiny.jpg", "new.jpg", "old.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("kept = %q, want %q", got, want)
+	}
+}
+
+func TestMostRecentLatestN(t *testing.T) {
+	files := func() []*file {
+		return []*file{
+			newFile("old.jpg", 1, 2*time.Hour),
+			newFile("new.jpg", 30, time.Hour),
+			newFile("newest.jpg", 20, 0),
+		}
+	}
+	r := testRunner()
+	r.LatestN = 2
+	kept, skipped, err := r.mostRecent(files(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(kept), []string{"newest.jpg", "new.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("kept = %q, want %q", got, want)
+	}
+	if got, want := paths(skipped), []string{"old.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("skipped = %q, want %q", got, want)
+	}
+	// Rather than fewer files.
+	if _, _, err := r.mostRecent(files(), 49); err == nil {
+		t.Error("mostRecent() succeeded with the 50 bytes of the newest files over the budget")
+	}
+}
+
+func TestMostRecentGroupSidecars(t *testing.T) {
+	files := func() []*file {
+		return []*file{
+			newFile("a/IMG_0001.CR2", 20, 0),
+			newFile("a/IMG_0001.JPG", 5, 0),
+			// Edited before the JPEG was exported.
+			newFile("a/IMG_0001.xmp", 1, 3*time.Hour),
+			newFile("a/IMG_0002.JPG", 5, time.Hour),
+			newFile("a/IMG_0002.xmp", 1, time.Hour),
+			newFile("b/IMG_0001.xmp", 1, 2*time.Hour),
+		}
+	}
+	for _, tc := range []struct {
+		budget int64
+		kept   []string
+	}{
+		{28, []string{"a/IMG_0001.CR2", "a/IMG_0001.JPG", "a/IMG_0001.xmp", "b/IMG_0001.xmp"}},
+		// On their own, IMG_0001.CR2 would fit.
+		{24, []string{"a/IMG_0002.JPG", "a/IMG_0002.xmp", "b/IMG_0001.xmp"}},
+	} {
+		r := testRunner()
+		r.GroupSidecars = true
+		r.Pack = true
+		kept, skipped, err := r.mostRecent(files(), tc.budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(kept); !slices.Equal(got, tc.kept) {
+			t.Errorf("kept = %q with a budget of %d, want %q", got, tc.budget, tc.kept)
+		}
+		if got, want := len(kept)+len(skipped), 6; got != want {
+			t.Errorf("%d kept and skipped, want %d", got, want)
+		}
+	}
+}
+
+func TestMostRecentBlockSize(t *testing.T) {
+	r := testRunner()
+	r.block = 16
+	files := []*file{
+		newFile("a.xmp", 1, 0),
+		newFile("b.xmp", 1, time.Hour),
+		newFile("c.xmp", 17, 2*time.Hour),
+	}
+	// The 19 bytes would fit, but they take 4 blocks.
+	kept, _, err := r.mostRecent(files, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(kept), []string{"a.xmp", "b.xmp"}; !slices.Equal(got, want) {
+		t.Errorf("kept = %q, want %q", got, want)
+	}
+}
+
+func TestMostRecentPerDir(t *testing.T) {
+	r := testRunner()
+	r.PerDirLimit = 2
+	files := []*file{
+		newFile("trip1/a.jpg", 10, 0),
+		newFile("trip1/b.jpg", 10, time.Hour),
+		newFile("trip1/c.jpg", 10, 2*time.Hour),
+		newFile("trip2/d.jpg", 10, 3*time.Hour),
+		newFile("trip2/e.jpg", 10, 4*time.Hour),
+		newFile("trip2/f.jpg", 10, 5*time.Hour),
+		newFile("trip3/g.jpg", 10, 6*time.Hour),
+	}
+	kept, skipped, err := r.mostRecent(files, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(kept), []string{"trip1/a.jpg", "trip1/b.jpg", "trip2/d.jpg", "trip2/e.jpg", "trip3/g.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("kept = %q, want %q", got, want)
+	}
+	if got, want := paths(skipped), []string{"trip1/c.jpg", "trip2/f.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("skipped = %q, want %q", got, want)
+	}
+}
+
+func TestMostRecentDedup(t *testing.T) {
+	files := []*file{
+		newFile("a.jpg", 10, 0),
+		newFile("copy-of-a.jpg", 10, time.Hour),
+		newFile("b.jpg", 10, 2*time.Hour),
+	}
+	files[0].hash, files[1].hash = "a", "a"
+	kept, _, err := testRunner().mostRecent(files, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(kept), []string{"a.jpg", "copy-of-a.jpg", "b.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("kept = %q, want %q", got, want)
+	}
+}
+
+func TestUsable(t *testing.T) {
+	for _, tc := range []struct {
+		fillPct int
+		reserve int64
+		cap     int64
+		want    int64
+	}{
+		{95, 0, 1000, 950},
+		{95, 100, 1000, 900},
+		{100, 0, 1000, 1000},
+		{95, 10, 1000, 950},
+	} {
+		r := testRunner()
+		r.FillPct = tc.fillPct
+		r.Reserve = tc.reserve
+		got, err := r.usable(tc.cap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("usable(%d) with --fill-pct=%d --reserve=%d = %d, want %d", tc.cap, tc.fillPct, tc.reserve, got, tc.want)
+		}
+	}
+	r := testRunner()
+	r.Reserve = 1000
+	if _, err := r.usable(1000); err == nil {
+		t.Error("usable() with --reserve as large as the capacity succeeded")
+	}
+}
+
+// The 95% boundary: a tree filling exactly the default budget is kept whole,
+// one more byte and the oldest file is dropped.
+func TestMostRecentFillPct(t *testing.T) {
+	r := testRunner()
+	budget, err := r.usable(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := makeTree(t,
+		entry{"a.jpg", 500, 0},
+		entry{"b.jpg", 450, time.Hour},
+	)
+	files, err := scan(context.Background(), root, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept, _, err := r.mostRecent(files, budget); err != nil || len(kept) != 2 {
+		t.Errorf("mostRecent() kept %q, %v; want both", paths(kept), err)
+	}
+	if kept, _, err := r.mostRecent(files, budget-1); err != nil || !slices.Equal(paths(kept), []string{"a.jpg"}) {
+		t.Errorf("mostRecent() kept %q, %v; want a.jpg", paths(kept), err)
+	}
+}
+
+// The semantics at the edge of the budget, which is usable(cap): 95% of cap
+// rounded down by default.
+//   - Files are taken newest first while they fit, and a file fits if the total
+//     including it is at most the budget. Filling the budget to the byte is
+//     fine, one more byte is not.
+//   - The first file which doesn't fit ends the selection (without --pack),
+//     even if older ones would fit, so that dst holds everything down to a
+//     cutoff date. A file larger than the whole budget thus selects nothing.
+//   - Once the budget is used up exactly, the selection is over too: a zero
+//     byte file after that point is left out like any other, so that the
+//     cutoff stays where the budget ran out. Before that point zero byte
+//     files are taken like any other.
+func TestMostRecentBoundary(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cap   int64
+		sizes []int64 // newest first
+		kept  int
+	}{
+		{"exactly 95%", 1000, []int64{500, 450}, 2},
+		{"just under", 1000, []int64{500, 449}, 2},
+		{"just over", 1000, []int64{500, 451}, 1},
+		{"rounded down", 999, []int64{500, 450}, 1},
+		{"larger than cap", 1000, []int64{1001, 1}, 0},
+		{"larger than the budget", 1000, []int64{951}, 0},
+		{"zero bytes at the boundary", 1000, []int64{950, 0}, 1},
+		{"zero bytes before the boundary", 1000, []int64{900, 0, 50}, 3},
+		{"zero bytes after a misfit", 1000, []int64{900, 51, 0}, 1},
+		{"only zero bytes", 1000, []int64{0, 0}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := testRunner()
+			budget, err := r.usable(tc.cap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []*file
+			for i, size := range tc.sizes {
+				files = append(files, newFile(fmt.Sprintf("%d.jpg", i), size, time.Duration(i)*time.Hour))
+			}
+			kept, skipped, err := r.mostRecent(files, budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kept) != tc.kept || len(kept)+len(skipped) != len(tc.sizes) {
+				t.Errorf("kept %q and skipped %q of %v in %d, want the first %d kept",
+					paths(kept), paths(skipped), tc.sizes, budget, tc.kept)
+			}
+		})
+	}
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	root := makeTree(t,
+		entry{"keep/x.jpg", 1, 0},
+		entry{"keep/empty/y.jpg", 1, 0},
+		entry{"gone/deeper/z.jpg", 1, 0},
+	)
+	for _, p := range []string{"keep/empty/y.jpg", "gone/deeper/z.jpg"} {
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testRunner().removeEmptyDirs(root); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]bool{
+		"keep":       true,
+		"keep/x.jpg": true,
+		"keep/empty": false,
+		"gone":       false,
+	} {
+		_, err := os.Stat(filepath.Join(root, filepath.FromSlash(p)))
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists: %v, want %v", p, exists, want)
+		}
+	}
+}
+
+func TestRemoveEmptyDirsKeepsRoot(t *testing.T) {
+	root := makeTree(t, entry{"a/b/x.jpg", 1, 0})
+	if err := os.Remove(filepath.Join(root, "a", "b", "x.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testRunner().removeEmptyDirs(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Fatalf("dst root removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); err == nil {
+		t.Error("a not removed")
+	}
+}
+
+func TestRemoveEmptyDirsKeepDirs(t *testing.T) {
+	r := testRunner()
+	r.KeepDirs = []string{".thumbnails"}
+	root := t.TempDir()
+	for _, d := range []string{"a/.thumbnails", "b"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(d)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.removeEmptyDirs(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a", ".thumbnails")); err != nil {
+		t.Errorf("kept dir removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b")); err == nil {
+		t.Error("b not removed")
+	}
+}
+
+func TestRotateTrash(t *testing.T) {
+	r := testRunner()
+	r.TrashMax = 100
+	root := makeTree(t,
+		entry{"a/old.jpg", 60, 3 * time.Hour},
+		entry{"a/mid.jpg", 50, 2 * time.Hour},
+		entry{"b/new.jpg", 40, time.Hour},
+	)
+	if err := r.rotateTrash(root); err != nil {
+		t.Fatal(err)
+	}
+	files, err := scan(context.Background(), root, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/mid.jpg", "b/new.jpg"}
+	if got := paths(files); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// By when they were trashed, not taken.
+	dst := makeTree(t, entry{"2010.jpg", 60, 13 * 365 * 24 * time.Hour}, entry{"2023.jpg", 60, 0})
+	trash := filepath.Join(dst, trashName)
+	if err := r.moveToTrash(filepath.Join(dst, "2023.jpg"), filepath.Join(trash, "2023.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	// As if by an earlier run.
+	earlier := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(trash, "2023.jpg"), earlier, earlier); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.moveToTrash(filepath.Join(dst, "2010.jpg"), filepath.Join(trash, "2010.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.rotateTrash(trash); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = scan(context.Background(), trash, scanOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"2010.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("trash holds %v after the rotation, want %v", got, want)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	r := testRunner()
+	r.DeleteWorkers = 3
+	r.DeleteKeepGoing = true
+	root := makeTree(t,
+		entry{"a/x.jpg", 1, 0},
+		entry{"b/c/y.jpg", 1, 0},
+		entry{"d/keep.jpg", 1, 0},
+		entry{"e/empty/.keep", 0, 0},
+	)
+	if err := os.Remove(filepath.Join(root, "e", "empty", ".keep")); err != nil {
+		t.Fatal(err)
+	}
+	d := &destination{runner: r, dir: root, sub: []*file{
+		newFile("a/x.jpg", 1, 0),
+		newFile("gone.jpg", 1, 0),
+		newFile("b/c/y.jpg", 1, 0),
+	}}
+	err := d.remove(context.Background())
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("remove() = %v, want the missing file", err)
+	}
+	if d.removed != 2 {
+		t.Errorf("removed %d files, want 2", d.removed)
+	}
+	for _, p := range []string{"a", "b"} {
+		if _, err := os.Stat(filepath.Join(root, p)); err == nil {
+			t.Errorf("%s not removed", p)
+		}
+	}
+	// Only the directories which held removed files are checked.
+	for _, p := range []string{"d/keep.jpg", "e/empty"} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+			t.Errorf("%s removed: %v", p, err)
+		}
+	}
+}
+
+func BenchmarkRemove(b *testing.B) {
+	r := testRunner()
+	r.DeleteWorkers = 8
+	quietLogs(b)
+	var entries []entry
+	var sub []*file
+	for i := 0; i < 2000; i++ {
+		path := fmt.Sprintf("%02d/%03d/%d.jpg", i%20, i%200, i)
+		entries = append(entries, entry{path, 0, 0})
+		sub = append(sub, newFile(path, 0, 0))
+	}
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		d := &destination{runner: r, dir: makeTree(b, entries...), sub: sub}
+		b.StartTimer()
+		if err := d.remove(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStillStored(t *testing.T) {
+	previous := []*file{newFile("a.jpg", 1, 0), newFile("b.jpg", 1, 0), newFile("gone.jpg", 1, 0)}
+	scanned := []*file{newFile("b.jpg", 2, 0), newFile("c.jpg", 1, 0)}
+	d := &destination{files: []*file{newFile("a.jpg", 1, 0), newFile("b.jpg", 1, 0)}}
+	if got, want := paths(stillStored(previous, scanned, []*destination{d})), []string{"a.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("stillStored() = %q, want %q", got, want)
+	}
+}
+
+func TestRunTranscode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command is for /bin/sh")
+	}
+	src := makeTree(t, entry{"a.jpg", 10, 0}, entry{"clip.MOV", 100, time.Hour})
+	dst := t.TempDir()
+	cfg := testConfig(t, src, dst)
+	cfg.Transcode = `head -c 30 "$CATALOG_INPUT" >"$CATALOG_OUTPUT"`
+	cfg.TranscodeExt = []string{"mov"}
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Counted as 30% of 100 bytes.
+	if s.Added != 2 || s.Bytes != 40 {
+		t.Errorf("Run() = %+v, want 2 files (40 bytes) added", s)
+	}
+	for path, want := range map[string]int64{
+		filepath.Join(src, "clip.MOV"): 100,
+		filepath.Join(dst, "clip.MOV"): 30,
+		filepath.Join(dst, "a.jpg"):    10,
+	} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != want {
+			t.Errorf("%s has %d bytes, want %d", path, fi.Size(), want)
+		}
+	}
+
+	// The version on dst is up to date.
+	s, err = Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 0 {
+		t.Errorf("Run() = %+v the second time, want nothing added", s)
+	}
+}
+
+func TestRunDirTimes(t *testing.T) {
+	src := makeTree(t, entry{"2020/05/a.jpg", 10, 0}, entry{"2021/b.jpg", 10, 48 * time.Hour})
+	for dir, age := range map[string]time.Duration{"2020": 24 * time.Hour, "2020/05": 12 * time.Hour, "2021": 36 * time.Hour} {
+		mtime := base.Add(-age)
+		if err := os.Chtimes(filepath.Join(src, filepath.FromSlash(dir)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := t.TempDir()
+	cfg := testConfig(t, src, dst)
+	cfg.MaxFiles = 1
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Created by the copy.
+	for dir, age := range map[string]time.Duration{"2020": 24 * time.Hour, "2020/05": 12 * time.Hour} {
+		fi, err := os.Stat(filepath.Join(dst, filepath.FromSlash(dir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := base.Add(-age); !fi.ModTime().Equal(want) {
+			t.Errorf("%s has mtime %s, want %s", dir, fi.ModTime(), want)
+		}
+	}
+	// Holds nothing kept.
+	if _, err := os.Stat(filepath.Join(dst, "2021")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("2021 was created: %v", err)
+	}
+}
+
+func TestRunDirTimesSeveralSrc(t *testing.T) {
+	photos := filepath.Join(makeTree(t, entry{"photos/2020/a.jpg", 10, 0}), "photos")
+	phone := filepath.Join(makeTree(t, entry{"phone/2021/b.jpg", 10, 0}), "phone")
+	for dir, age := range map[string]time.Duration{photos: 48 * time.Hour, photos + "/2020": 24 * time.Hour, phone + "/2021": 12 * time.Hour} {
+		mtime := base.Add(-age)
+		if err := os.Chtimes(filepath.FromSlash(dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := t.TempDir()
+	cfg := testConfig(t, photos, dst)
+	cfg.ExtraSrc = []string{phone}
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Each root's under its label.
+	for dir, age := range map[string]time.Duration{"photos": 48 * time.Hour, "photos/2020": 24 * time.Hour, "phone/2021": 12 * time.Hour} {
+		fi, err := os.Stat(filepath.Join(dst, filepath.FromSlash(dir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := base.Add(-age); !fi.ModTime().Equal(want) {
+			t.Errorf("%s has mtime %s, want %s", dir, fi.ModTime(), want)
+		}
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	src := makeTree(t,
+		entry{"a.jpg", 10, 0},
+		entry{"b.jpg", 10, time.Hour},
+		entry{"c.jpg", 10, 2 * time.Hour},
+	)
+	dst := makeTree(t, entry{"gone.jpg", 1, 0})
+	cfg := testConfig(t, src, dst)
+	cfg.MaxFiles = 2
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 2 || s.Bytes != 20 || s.Removed != 1 || s.Skipped != 1 {
+		t.Errorf("Run() = %+v, want 2 files (20 bytes) added, 1 removed and 1 skipped", s)
+	}
+	if want := base.Add(-time.Hour); !s.Cutoff.Equal(want) {
+		t.Errorf("Cutoff = %s, want %s", s.Cutoff, want)
+	}
+	if want := base.Add(-2 * time.Hour); !s.NewestSkipped.Equal(want) {
+		t.Errorf("NewestSkipped = %s, want %s", s.NewestSkipped, want)
+	}
+
+	// Everything fits the second time around.
+	cfg.MaxFiles = 0
+	s, err = Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 1 || !s.Cutoff.IsZero() || !s.NewestSkipped.IsZero() {
+		t.Errorf("Run() = %+v, want 1 file added and no cutoff", s)
+	}
+}
+
+func TestRunStatOnly(t *testing.T) {
+	src := makeTree(t,
+		entry{"a.jpg", 10, 0},
+		entry{"b.jpg", 20, time.Hour},
+		entry{"c.jpg", 30, 2 * time.Hour},
+	)
+	dst := makeTree(t, entry{"old.jpg", 1, 0})
+	cfg := testConfig(t, src, dst)
+	cfg.StatOnly = true
+	cfg.MaxFiles = 2
+	out := captureLogs(t)
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 0 || s.Removed != 0 || s.Bytes != 0 {
+		t.Errorf("Run() = %+v, want nothing added or removed", s)
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "old.jpg" {
+		t.Errorf("dst holds %v, want only old.jpg", entries)
+	}
+	var stats, fit struct {
+		Files   int   `json:"files"`
+		Size    int64 `json:"size"`
+		Skipped int   `json:"skipped"`
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		switch {
+		case strings.Contains(line, `"action":"stats"`):
+			json.Unmarshal([]byte(line), &stats)
+		case strings.Contains(line, `"action":"stats-fit"`):
+			json.Unmarshal([]byte(line), &fit)
+		}
+	}
+	if stats.Files != 3 || stats.Size != 60 {
+		t.Errorf("stats = %+v, want 3 files (60 bytes)", stats)
+	}
+	if fit.Files != 2 || fit.Size != 30 || fit.Skipped != 1 {
+		t.Errorf("stats-fit = %+v, want 2 files (30 bytes) fitting and 1 left out", fit)
+	}
+}
+
+func TestRunKeepsDstSystemFiles(t *testing.T) {
+	src := makeTree(t, entry{"a.jpg", 10, 0}, entry{".hidden/b.jpg", 10, 0})
+	// Copied by a run from before --skip-system-files, or put there by the
+	// device.
+	dst := makeTree(t,
+		entry{".hidden/b.jpg", 10, 0},
+		entry{".DS_Store", 1, 0},
+		entry{"old.jpg", 1, 0},
+		entry{".old.jpg.123.tmp", 1, 0},
+	)
+	cfg := testConfig(t, src, dst)
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 1 || s.Removed != 2 {
+		t.Errorf("Run() = %+v, want 1 file added and 2 removed", s)
+	}
+	for p, want := range map[string]bool{".hidden/b.jpg": true, ".DS_Store": true, "old.jpg": false, ".old.jpg.123.tmp": false} {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(p)))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists: %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestRunNoDelete(t *testing.T) {
+	src := makeTree(t, entry{"a.jpg", 10, 0})
+	dst := makeTree(t, entry{"old/gone.jpg", 1, 0})
+	cfg := testConfig(t, src, dst)
+	cfg.NoDelete = true
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 1 || s.Removed != 0 {
+		t.Errorf("Run() = %+v, want 1 file added and none removed", s)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old", "gone.jpg")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunDedupeAcrossSrcDst(t *testing.T) {
+	src := makeTree(t,
+		entry{"2024/a.jpg", 10, 0},
+		entry{"b.jpg", 20, 0},
+		entry{"2024/b.jpg", 20, 0},
+		entry{"c.jpg", 30, 0},
+	)
+	dst := makeTree(t,
+		entry{"a.jpg", 10, time.Hour},
+		entry{"b.jpg", 20, 0},
+	)
+	// The same size as c.jpg but not its content.
+	if err := os.WriteFile(filepath.Join(dst, "other.jpg"), bytes.Repeat([]byte{1}, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, src, dst)
+	cfg.DedupeAcrossSrcDst = true
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 1 || s.Removed != 1 {
+		t.Errorf("Run() = %+v, want c.jpg added and other.jpg removed", s)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.jpg")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a.jpg is still in dst: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "2024", "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(base) {
+		t.Errorf("2024/a.jpg has mtime %s, want the src one %s", fi.ModTime(), base)
+	}
+	if same, err := sameFile(filepath.Join(dst, "2024", "b.jpg"), filepath.Join(dst, "b.jpg")); err != nil || !same {
+		t.Errorf("2024/b.jpg isn't a hard link to b.jpg: %v", err)
+	}
+}
+
+func TestRunSeveralSrc(t *testing.T) {
+	photos := filepath.Join(makeTree(t, entry{"photos/2024/a.jpg", 10, 0}), "photos")
+	phone := filepath.Join(makeTree(t, entry{"phone/2024/a.jpg", 20, time.Hour}), "phone")
+	dst := t.TempDir()
+	cfg := testConfig(t, photos, dst)
+	cfg.ExtraSrc = []string{phone}
+	cfg.Verify = true
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	// The same path in both, each under its root's name.
+	for path, size := range map[string]int64{"photos/2024/a.jpg": 10, "phone/2024/a.jpg": 20} {
+		fi, err := os.Stat(filepath.Join(dst, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != size {
+			t.Errorf("%s has size %d, want %d", path, fi.Size(), size)
+		}
+	}
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Added != 0 || s.Removed != 0 {
+		t.Errorf("second Run() = %+v, want nothing to do", s)
+	}
+
+	cfg.ExtraSrc = []string{filepath.Join(t.TempDir(), "photos")}
+	if _, err := Run(context.Background(), cfg); err == nil {
+		t.Error("Run() succeeded with two --src named photos")
+	}
+}
+
+func TestRunTiming(t *testing.T) {
+	src := makeTree(t, entry{"a/b.jpg", 10, 0})
+	dst := makeTree(t, entry{"old/gone.jpg", 1, 0})
+	cfg := testConfig(t, src, dst)
+	cfg.Timing = true
+	out := captureLogs(t)
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		var rec struct {
+			Action string `json:"action"`
+			Phase  string `json:"phase"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err == nil && rec.Action == "timing" {
+			got = append(got, rec.Phase)
+		}
+	}
+	want := []string{"src scan", "dst scan", "select", "compare", "delete", "empty dirs", "copy", "dir attributes", "other"}
+	if !slices.Equal(got, want) {
+		t.Errorf("phases = %q, want %q", got, want)
+	}
+}
+
+func TestRunPruneSrc(t *testing.T) {
+	src := makeTree(t,
+		entry{"new.jpg", 10, 0},
+		entry{"mid.jpg", 10, time.Hour},
+		entry{"old.jpg", 10, 100 * time.Hour},
+	)
+	cfg := testConfig(t, src, t.TempDir())
+	cfg.MaxFiles = 1
+	cfg.Verify = true
+	// The test files are dated relative to base.
+	cfg.PruneSrcOlder = time.Since(base) + 50*time.Hour
+	if _, err := Run(context.Background(), cfg); err == nil {
+		t.Fatal("Run() succeeded without --i-understand-this-deletes-source")
+	}
+	cfg.SrcDeletesUnderstood = true
+	if runtime.GOOS != "windows" {
+		// The post-hook is fatal, so this fails Run unless src is pruned first.
+		cfg.PostHook = "test ! -e '" + filepath.Join(src, "old.jpg") + "' && test \"$CATALOG_PRUNED\" = 1"
+	}
+	s, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pruned != 1 {
+		t.Errorf("Pruned = %d, want 1", s.Pruned)
+	}
+	files, err := scan(context.Background(), src, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(files), []string{"mid.jpg", "new.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("src = %q, want %q", got, want)
+	}
+}
+
+func TestRunIgnoreErrors(t *testing.T) {
+	src := makeTree(t, entry{"a.jpg", 10, 0}, entry{"b.jpg", 10, 0})
+	// A directory where b.jpg is to be copied, which --no-delete leaves.
+	dst := makeTree(t, entry{"b.jpg/x", 1, 0})
+	cfg := testConfig(t, src, dst)
+	cfg.NoDelete = true
+	cfg.IgnoreErrors = true
+	s, err := Run(context.Background(), cfg)
+	if err == nil {
+		t.Fatal("Run() succeeded despite the failed copy")
+	}
+	if len(s.Errors) != 1 || s.Added != 1 {
+		t.Errorf("Run() = %+v, want 1 file added and 1 error", s)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.jpg")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	r := testRunner()
+	r.IgnoreErrors = true
+	quietLogs(t)
+	if err := r.ignore(&fs.PathError{Op: "open", Path: "a.jpg", Err: fs.ErrPermission}); err != nil {
+		t.Errorf("ignore(permission denied) = %v, want nil", err)
+	}
+	full := &fs.PathError{Op: "write", Path: "b.jpg", Err: syscall.ENOSPC}
+	if err := r.ignore(full); err != full {
+		t.Errorf("ignore(no space) = %v, want it back", err)
+	}
+	if len(r.summary.Errors) != 1 {
+		t.Errorf("Errors = %q, want the permission error", r.summary.Errors)
+	}
+}
+
+func TestRunLinkOnly(t *testing.T) {
+	for _, hard := range []bool{false, true} {
+		src := makeTree(t, entry{"a.jpg", 10, 0}, entry{"x/b.jpg", 10, time.Hour})
+		dst := t.TempDir()
+		cfg := testConfig(t, src, dst)
+		cfg.LinkOnly, cfg.Hardlink = true, hard
+		s, err := Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Added != 2 || !s.LinkOnly {
+			t.Errorf("hardlink=%v: Run() = %+v, want 2 files linked", hard, s)
+		}
+		for _, p := range []string{"a.jpg", filepath.Join("x", "b.jpg")} {
+			si, err := os.Stat(filepath.Join(src, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			di, err := os.Lstat(filepath.Join(dst, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hard != os.SameFile(si, di) || hard == (di.Mode()&fs.ModeSymlink != 0) {
+				t.Errorf("hardlink=%v: %s is %s, not a link to src", hard, p, di.Mode())
+			}
+		}
+
+		// The links are up to date, down to the one left dangling.
+		if err := os.Remove(filepath.Join(src, "a.jpg")); err != nil {
+			t.Fatal(err)
+		}
+		s, err = Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Added != 0 || s.Removed != 1 {
+			t.Errorf("hardlink=%v: second Run() = %+v, want 1 file removed", hard, s)
+		}
+	}
+}
+
+func TestRunSummaryJSON(t *testing.T) {
+	src := makeTree(t, entry{"a.jpg", 10, 0})
+	cfg := testConfig(t, src, t.TempDir())
+	cfg.SummaryJSON = filepath.Join(t.TempDir(), "summary.json")
+	read := func() summaryRecord {
+		t.Helper()
+		b, err := os.ReadFile(cfg.SummaryJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec summaryRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if rec := read(); !rec.OK || rec.Added != 1 || rec.Bytes != 10 || rec.Cutoff != nil {
+		t.Errorf("summary = %+v, want 1 file (10 bytes) added and no cutoff", rec)
+	}
+	cfg.FillPct = 0
+	if _, err := Run(context.Background(), cfg); err == nil {
+		t.Fatal("Run() succeeded with --fill-pct=0")
+	}
+	if rec := read(); rec.OK || !strings.Contains(rec.Error, "--fill-pct") {
+		t.Errorf("summary = %+v, want the --fill-pct error", rec)
+	}
+}
+
+func TestLockDsts(t *testing.T) {
+	r := testRunner()
+	r.Dst = []string{t.TempDir(), "pi:/photos"}
+	unlock, err := r.lockDsts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testRunner()
+	other.Dst = r.Dst
+	other.LockWait = 50 * time.Millisecond
+	quietLogs(t)
+	if _, err := other.lockDsts(context.Background()); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lockDsts() while locked = %v, want ErrLocked", err)
+	}
+	unlock()
+	unlock, err = other.lockDsts(context.Background())
+	if err != nil {
+		t.Fatalf("lockDsts() after unlocking = %v", err)
+	}
+	unlock()
+}
+
+func TestReportCoverage(t *testing.T) {
+	src := makeTree(t,
+		entry{"a.jpg", 30, 0},
+		entry{"b.jpg", 10, time.Hour},
+		entry{"c.jpg", 60, 48 * time.Hour},
+		entry{"d.jpg", 100, 72 * time.Hour},
+	)
+	// c.jpg is older on dst, as if src's was edited since.
+	dst := makeTree(t, entry{"a.jpg", 30, 0}, entry{"b.jpg", 10, time.Hour}, entry{"c.jpg", 60, 96 * time.Hour})
+	out := captureLogs(t)
+	r := testRunner()
+	r.Src, r.Dst = src, []string{dst}
+	files, err := r.scanDir(context.Background(), src, r.srcScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reportCoverage(context.Background(), files); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Files    int     `json:"files"`
+		FilesPct float64 `json:"files_pct"`
+		SizePct  float64 `json:"size_pct"`
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, `"action":"coverage"`) {
+			if err := json.Unmarshal([]byte(line), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got.Files != 2 || got.FilesPct != 50 || got.SizePct != 20 {
+		t.Errorf("coverage = %+v, want 2 files, 50%% of them and 20%% of the bytes", got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	out := captureLogs(t)
+	r := testRunner()
+	r.LogFormat = "json"
+	ch := make(chan os.Signal)
+	r.Status = ch
+	stop := r.watchStatus()
+	d := &destination{runner: r, dir: "/dst", sub: []*file{newFile("x.jpg", 1, 0), newFile("y.jpg", 1, 0)}}
+	d.removed = 1
+	r.summary.Added = 5
+	r.setPhase("copy")
+	r.setSyncing(d)
+	pw := d.newProgressWriter(io.Discard, []*file{newFile("a.jpg", 10, 0), newFile("b.jpg", 10, 0), newFile("c.jpg", 10, 0)})
+	fmt.Fprint(pw, "a.jpg\n")
+	r.setCopying(pw)
+	ch <- syscall.SIGHUP
+	stop()
+	var got struct {
+		Phase      string `json:"phase"`
+		Dst        string `json:"dst"`
+		DstRemoved int    `json:"dst_removed"`
+		DstCopied  int    `json:"dst_copied"`
+		DstToCopy  int    `json:"dst_to_copy"`
+		Added      int    `json:"added"`
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		var rec struct {
+			Action string `json:"action"`
+		}
+		if json.Unmarshal([]byte(line), &rec) == nil && rec.Action == "status" {
+			json.Unmarshal([]byte(line), &got)
+		}
+	}
+	if got.Phase != "copy" || got.Dst != "/dst" || got.DstRemoved != 1 || got.DstCopied != 1 || got.DstToCopy != 3 || got.Added != 5 {
+		t.Errorf("status = %+v, want copy to /dst with 1 removed, 1 of 3 copied and 5 added before", got)
+	}
+}
+
+func TestReportExtensions(t *testing.T) {
+	out := captureLogs(t)
+	testRunner().reportExtensions("library", []*file{
+		newFile("a.JPG", 10, 0), newFile("b.jpg", 5, 0), newFile("c.mov", 100, 0),
+		newFile("README", 1, 0), newFile("d/Makefile", 2, 0), newFile("e.xmp", 3, 0),
+	})
+	type stats struct {
+		Of    string `json:"of"`
+		Ext   string `json:"ext"`
+		Files int    `json:"files"`
+		Size  int64  `json:"size"`
+	}
+	var got []stats
+	for _, line := range strings.Split(out.String(), "\n") {
+		var s stats
+		if strings.Contains(line, `"action":"extension"`) {
+			if err := json.Unmarshal([]byte(line), &s); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, s)
+		}
+	}
+	// By size, largest first, then by extension.
+	want := []stats{{"library", ".mov", 1, 100}, {"library", ".jpg", 2, 15}, {"library", "(none)", 2, 3}, {"library", ".xmp", 1, 3}}
+	if !slices.Equal(got, want) {
+		t.Errorf("reportExtensions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTreePreview(t *testing.T) {
+	out := captureLogs(t)
+	r := testRunner()
+	r.TreePreviewDepth = 2
+	d := &destination{runner: r, dir: "/dst",
+		add: []*file{newFile("2024/06/a.jpg", 10, 0), newFile("2024/06/b/c.jpg", 20, 0), newFile("2024/07/d.jpg", 5, 0), newFile("e.jpg", 1, 0)},
+		sub: []*file{newFile("2024/06/old.jpg", 3, 0)},
+	}
+	d.treePreview()
+	type change struct {
+		Dir       string `json:"dir"`
+		Added     int    `json:"added"`
+		AddedSize int64  `json:"added_size"`
+		Removed   int    `json:"removed"`
+	}
+	var got []change
+	for _, line := range strings.Split(out.String(), "\n") {
+		var c change
+		if strings.Contains(line, `"dir":`) {
+			if err := json.Unmarshal([]byte(line), &c); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c)
+		}
+	}
+	want := []change{{"./", 1, 1, 0}, {"2024/06/", 2, 30, 1}, {"2024/07/", 1, 5, 0}}
+	if !slices.Equal(got, want) {
+		t.Errorf("treePreview() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunDiffManifest(t *testing.T) {
+	src := makeTree(t,
+		entry{"a/keep.jpg", 10, 0},
+		entry{"a/resized.jpg", 10, time.Hour},
+		entry{"b/gone.jpg", 10, 2 * time.Hour},
+		entry{"b/old.jpg", 10, 96 * time.Hour},
+	)
+	dst := t.TempDir()
+	cfg := testConfig(t, src, dst)
+	cfg.MaxFiles = 3
+	out := captureLogs(t)
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Taken along, with dst left behind.
+	b, err := os.ReadFile(filepath.Join(dst, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(t.TempDir(), manifestName)
+	if err := os.WriteFile(manifest, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(src, "b", "gone.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a", "resized.jpg"), make([]byte, 15), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "c", "new.jpg"), make([]byte, 5), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	cfg.Dst = nil
+	cfg.DiffManifest = manifest
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	type change struct {
+		Dir     string `json:"dir"`
+		Added   int    `json:"added"`
+		Changed int    `json:"changed"`
+		Removed int    `json:"removed"`
+	}
+	var got []change
+	for _, line := range strings.Split(out.String(), "\n") {
+		var c change
+		if strings.Contains(line, `"dir":`) {
+			if err := json.Unmarshal([]byte(line), &c); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c)
+		}
+	}
+	// b/old.jpg didn't make it the last time either.
+	want := []change{{"a/", 0, 1, 0}, {"b/", 0, 0, 1}, {"c/", 1, 0, 0}}
+	if !slices.Equal(got, want) {
+		t.Errorf("tree = %+v, want %+v", got, want)
+	}
+}
+
+func TestManifestCompression(t *testing.T) {
+	m := &manifest{Src: "/photos", Files: []manifestEntry{{Path: "a.jpg", Size: 10}}}
+	plain, err := marshalManifest(m, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range []string{"none", "gzip", "zstd"} {
+		dir := t.TempDir()
+		if err := writeManifest(dir, m, algo); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, manifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := !bytes.Equal(b, plain); compressed != (algo != "none") {
+			t.Errorf("%s manifest compressed: %t", algo, compressed)
+		}
+		got, err := readManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Src != m.Src || !slices.Equal(got.Files, m.Files) {
+			t.Errorf("%s manifest read back as %+v, want %+v", algo, got, m)
+		}
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	dir := t.TempDir()
+	root := string(filepath.Separator)
+	if ok, err := isMountPoint(root); err != nil || !ok {
+		t.Errorf("isMountPoint(%q) = %t, %v, want true", root, ok, err)
+	}
+	r := testRunner()
+	r.Dst = []string{dir, "host:/remote"}
+	r.RequireMount = true
+	if err := r.checkMounts(); err == nil {
+		t.Errorf("checkMounts() succeeded for %s, which isn't a mount point", dir)
+	}
+
+	typ, err := fsType(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequireMount = false
+	r.ExpectFSType = strings.ToUpper(typ)
+	if err := r.checkMounts(); err != nil {
+		t.Error(err)
+	}
+	r.ExpectFSType = "nosuchfs"
+	if err := r.checkMounts(); err == nil {
+		t.Errorf("checkMounts() succeeded for %s on %s with --expect-fstype=nosuchfs", dir, typ)
+	}
+}
+
+func TestConfirmed(t *testing.T) {
+	for in, want := range map[string]error{
+		"y\n":      nil,
+		"Yes\n":    nil,
+		" yes ":    nil,
+		"\n":       ErrNotConfirmed,
+		"":         ErrNotConfirmed,
+		"no\n":     ErrNotConfirmed,
+		"yesno\ny": ErrNotConfirmed,
+	} {
+		if err := confirmed(strings.NewReader(in)); err != want {
+			t.Errorf("confirmed(%q) = %v, want %v", in, err, want)
+		}
+	}
+}
+
+func TestDropVanished(t *testing.T) {
+	s := &stderrScanner{w: io.Discard}
+	fmt.Fprint(s, "rsync: stat failed\nfile has vanished: \"/src/a/x.jpg\"\nfile has ")
+	fmt.Fprint(s, "vanished: \"b.jpg\"\n")
+	r := testRunner()
+	r.Src = "/src"
+	d := &destination{runner: r,
+		add:  []*file{newFile("a/x.jpg", 1, 0), newFile("b.jpg", 1, 0), newFile("c.jpg", 1, 0)},
+		keep: []*file{newFile("a/x.jpg", 1, 0), newFile("b.jpg", 1, 0), newFile("c.jpg", 1, 0), newFile("d.jpg", 1, 0)},
+	}
+	quietLogs(t)
+	d.dropVanished(s.vanished)
+	if got, want := paths(d.add), []string{"c.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("add = %q, want %q", got, want)
+	}
+	if got, want := paths(d.keep), []string{"c.jpg", "d.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("keep = %q, want %q", got, want)
+	}
+}
+
+func TestRsyncOutOfSpace(t *testing.T) {
+	s := &stderrScanner{w: io.Discard}
+	fmt.Fprint(s, "rsync: [receiver] write failed on \"/dst/b.jpg\": No space left on device (28)\n")
+	if !s.noSpace {
+		t.Fatal("noSpace isn't set")
+	}
+	// rsync -P left part of b.jpg.
+	dir := makeTree(t, entry{"a.jpg", 10, 0}, entry{"b.jpg", 4, 0})
+	files := []*file{newFile("a.jpg", 10, 0), newFile("b.jpg", 10, 0), newFile("c.jpg", 10, 0)}
+	d := &destination{runner: testRunner(), dir: dir,
+		add:  slices.Clone(files),
+		keep: append(slices.Clone(files), newFile("d.jpg", 1, 0)),
+	}
+	pw := d.newProgressWriter(io.Discard, d.add)
+	fmt.Fprint(pw, "a.jpg\nb.jpg\n")
+	quietLogs(t)
+	d.rsyncOutOfSpace(pw, errors.New("exit status 11"))
+	if got, want := paths(d.add), []string{"a.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("add = %q, want %q", got, want)
+	}
+	if got, want := paths(d.keep), []string{"a.jpg", "d.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("keep = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.jpg")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("partial b.jpg is still there: %v", err)
+	}
+	if !errors.Is(d.noSpace, ErrNoSpace) {
+		t.Errorf("noSpace = %v, want ErrNoSpace", d.noSpace)
+	}
+}
+
+// fakeRsync stands in for rsync, recording what it was asked to copy and
+// printing the files like rsync -v, without copying them.
+type fakeRsync struct {
+	args   []string
+	files  []string // of the --files-from list
+	stderr string   // printed after the files
+	err    error    // returned by run
+}
+
+func (*fakeRsync) find(string) error { return nil }
+
+func (r *fakeRsync) run(ctx context.Context, path string, args []string, stdout, stderr io.Writer) error {
+	r.args = args
+	for _, a := range args {
+		if list, ok := strings.CutPrefix(a, "--files-from="); ok {
+			b, err := os.ReadFile(list)
+			if err != nil {
+				return err
+			}
+			r.files = strings.Fields(string(b))
+		}
+	}
+	for _, f := range r.files {
+		fmt.Fprintln(stdout, f)
+	}
+	fmt.Fprint(stderr, r.stderr)
+	return r.err
+}
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are for /bin/sh")
+	}
+	src := makeTree(t, entry{"a.jpg", 10, 0}, entry{"b.jpg", 10, time.Hour})
+	dst := makeTree(t, entry{"gone.jpg", 1, 0})
+	out := t.TempDir()
+	pre, post := filepath.Join(out, "pre"), filepath.Join(out, "post")
+	// The CATALOG_ variables the hook saw, or nil if it didn't run.
+	env := func(path string) map[string]string {
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		vars := make(map[string]string)
+		for _, line := range strings.Split(string(b), "\n") {
+			if k, v, ok := strings.Cut(line, "="); ok && strings.HasPrefix(k, "CATALOG_") {
+				vars[k] = v
+			}
+		}
+		return vars
+	}
+	cfg := testConfig(t, src, dst)
+	cfg.PreHook = "env >'" + pre + "'"
+	cfg.PostHook = "env >'" + post + "'"
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if env(pre) == nil {
+		t.Error("the pre-hook didn't run")
+	}
+	want := map[string]string{
+		"CATALOG_ADDED":   "2",
+		"CATALOG_REMOVED": "1",
+		"CATALOG_BYTES":   "20",
+		"CATALOG_PRUNED":  "0",
+		"CATALOG_SRC":     src,
+		"CATALOG_DST":     dst,
+		"CATALOG_DRY_RUN": "false",
+	}
+	if got := env(post); !maps.Equal(got, want) {
+		t.Errorf("the post-hook saw %v, want %v", got, want)
+	}
+
+	cfg.PreHook = "exit 1"
+	if _, err := Run(context.Background(), cfg); err == nil {
+		t.Error("Run() succeeded with a failing pre-hook")
+	}
+	if env(post) != nil {
+		t.Error("the post-hook ran after the pre-hook failed")
+	}
+
+	cfg.PreHook = ""
+	cfg.PostHook = "exit 3"
+	if _, err := Run(context.Background(), cfg); err == nil {
+		t.Error("Run() succeeded with a failing post-hook")
+	}
+	cfg.PostHookFatal = false
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Errorf("Run() = %v with a failing post-hook and PostHookFatal unset, want it ignored", err)
+	}
+
+	// Not after the copy failed, which the fake rsync doesn't even do.
+	cfg.PostHook = "env >'" + post + "'"
+	cfg.Copier = "rsync"
+	for _, fake := range []*fakeRsync{
+		{stderr: "rsync: [receiver] write failed on \"/dst/b.jpg\": No space left on device (28)\n", err: errors.New("exit status 11")},
+		{},
+	} {
+		cfg.Dst = []string{t.TempDir()}
+		cfg.Verify = fake.err == nil
+		r := newRunner(cfg)
+		r.rsync = fake
+		if _, err := r.runAll(context.Background()); err == nil {
+			t.Errorf("runAll() succeeded with verify=%v and rsync failing with %v", cfg.Verify, fake.err)
+		}
+		if env(post) != nil {
+			t.Errorf("the post-hook ran with verify=%v and rsync failing with %v", cfg.Verify, fake.err)
+		}
+	}
+}
+
+func TestRunRsync(t *testing.T) {
+	src := makeTree(t, entry{"a.jpg", 10, 0}, entry{"b/c.jpg", 10, time.Hour}, entry{"d.jpg", 10, 2 * time.Hour})
+	dst := t.TempDir()
+	cfg := testConfig(t, src, dst)
+	cfg.Copier = "rsync"
+	cfg.MaxFiles = 2
+	cfg.BWLimit = 1 << 20
+	r := newRunner(cfg)
+	fake := &fakeRsync{}
+	r.rsync = fake
+	s, err := r.runAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.jpg", filepath.Join("b", "c.jpg")}; !slices.Equal(fake.files, want) {
+		t.Errorf("--files-from lists %q, want %q", fake.files, want)
+	}
+	for _, want := range []string{"-Pav", "--mkpath", "--bwlimit=1024"} {
+		if !slices.Contains(fake.args, want) {
+			t.Errorf("rsync args %q lack %s", fake.args, want)
+		}
+	}
+	if n := len(fake.args); n < 2 || fake.args[n-2] != src || fake.args[n-1] != dst {
+		t.Errorf("rsync args %q don't end in %s %s", fake.args, src, dst)
+	}
+	if s.Added != 2 || s.Bytes != 20 {
+		t.Errorf("Run() = %+v, want 2 files (20 bytes) added", s)
+	}
+}
+
+func TestRsyncArgsBWLimit(t *testing.T) {
+	for limit, want := range map[int64]string{10 << 20: "--bwlimit=10240", 1536: "--bwlimit=1", 100: "--bwlimit=1"} {
+		cfg := DefaultConfig()
+		cfg.BWLimit = limit
+		if args := newRunner(cfg).rsyncArgs("list", "/dst"); !slices.Contains(args, want) {
+			t.Errorf("--bwlimit=%d: rsync args %q lack %s", limit, args, want)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	r := testRunner()
+	r.bandwidth = &limiter{rate: 10000, start: time.Now()}
+	var out bytes.Buffer
+	start := time.Now()
+	// In chunks of a tenth of the rate, the last one written after 0.2s.
+	n, err := r.throttle(&out).Write(make([]byte, 3000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3000 || out.Len() != 3000 {
+		t.Errorf("Write() = %d and wrote %d bytes, want 3000", n, out.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("3000 bytes took %s at 10000 bytes/s, want about 0.2s", elapsed)
+	}
+}
+
+func TestParseRsyncRate(t *testing.T) {
+	for line, want := range map[string]float64{
+		"  10,485,760 100%   95.24MB/s    0:00:00 (xfr#1, to-chk=0/1)": 95.24 * (1 << 20),
+		"      32,768   0%    0.00kB/s    0:00:00":                     0,
+		"         512 100%  500.00B/s    0:00:01":                      500,
+	} {
+		if got, ok := parseRsyncRate(line); !ok || math.Abs(got-want) > 1 {
+			t.Errorf("parseRsyncRate(%q) = %f, %t, want %f", line, got, ok, want)
+		}
+	}
+	for _, line := range []string{"a.jpg", "sending incremental file list", "100% done 5MB/s", ""} {
+		if got, ok := parseRsyncRate(line); ok {
+			t.Errorf("parseRsyncRate(%q) = %f, want no rate", line, got)
+		}
+	}
+}
+
+func TestCopyFileReplaces(t *testing.T) {
+	src := makeTree(t, entry{"x.jpg", 10, time.Hour})
+	dst := makeTree(t, entry{"a/x.jpg", 3, 0})
+	dstPath := filepath.Join(dst, "a", "x.jpg")
+	if err := testRunner().copyFile(filepath.Join(src, "x.jpg"), dstPath); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 10 || !fi.ModTime().Equal(base.Add(-time.Hour)) {
+		t.Errorf("copy has size %d, mtime %s, want 10, %s", fi.Size(), fi.ModTime(), base.Add(-time.Hour))
+	}
+	entries, err := os.ReadDir(filepath.Dir(dstPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory of the copy, want only the copy", len(entries))
+	}
+}
+
+func TestCopyFilePreserve(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows only has a read-only bit")
+	}
+	src := makeTree(t, entry{"x.jpg", 10, time.Hour})
+	srcPath := filepath.Join(src, "x.jpg")
+	if err := os.Chmod(srcPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		preserve []string
+		mode     fs.FileMode
+	}{
+		{[]string{"mode", "times"}, 0700},
+		{[]string{"times"}, createPerm},
+	} {
+		r := testRunner()
+		r.Preserve = tc.preserve
+		dstPath := filepath.Join(t.TempDir(), "x.jpg")
+		if err := r.copyFile(srcPath, dstPath); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(dstPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != tc.mode || !fi.ModTime().Equal(base.Add(-time.Hour)) {
+			t.Errorf("--preserve=%s: copy has mode %s, mtime %s, want %s, %s", strings.Join(tc.preserve, ","), fi.Mode().Perm(), fi.ModTime(), tc.mode, base.Add(-time.Hour))
+		}
+	}
+}
+
+func TestCopyFileFails(t *testing.T) {
+	// A directory, which can be opened but not read.
+	src := makeTree(t, entry{"x.jpg/y.jpg", 10, 0})
+	dst := makeTree(t, entry{"a/x.jpg", 3, 0})
+	dstPath := filepath.Join(dst, "a", "x.jpg")
+	if err := testRunner().copyFile(filepath.Join(src, "x.jpg"), dstPath); err == nil {
+		t.Fatal("copyFile() succeeded with an unreadable src")
+	}
+	fi, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3 {
+		t.Errorf("%s has %d bytes, want the old 3", dstPath, fi.Size())
+	}
+	entries, err := os.ReadDir(filepath.Dir(dstPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory of the copy, want no temporary file left", len(entries))
+	}
+}
+
+func TestCopyNative(t *testing.T) {
+	quietLogs(t)
+	src := makeTree(t, entry{"2023/06/a.jpg", 10, time.Hour}, entry{"b.jpg", 20, 0})
+	dst := t.TempDir()
+	r := testRunner()
+	r.Src, r.Copier = src, "native"
+	d := &destination{runner: r, dir: dst, add: []*file{newFile("2023/06/a.jpg", 10, time.Hour), newFile("b.jpg", 20, 0)}}
+	var out strings.Builder
+	if err := d.copyNative(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), filepath.FromSlash("2023/06/a.jpg")+"\nb.jpg\n"; got != want {
+		t.Errorf("copyNative() printed %q, want %q", got, want)
+	}
+	for _, f := range d.add {
+		fi, err := os.Stat(filepath.Join(dst, f.path()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != f.size || !fi.ModTime().Equal(f.modTime) {
+			t.Errorf("%s has size %d, mtime %s, want %d, %s", f.path(), fi.Size(), fi.ModTime(), f.size, f.modTime)
+		}
+	}
+}
+
+func TestCopyFileRanges(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	srcPath, dstPath := filepath.Join(src, "x.mp4"), filepath.Join(dst, "x.mp4")
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(srcPath, base, base); err != nil {
+		t.Fatal(err)
+	}
+	r := testRunner()
+	// Not a divisor of the size, so the last range is shorter.
+	r.ThreadsPerFile, r.ThreadsMinSize = 3, 1
+	if err := r.copyFile(srcPath, dstPath); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("copy differs from src")
+	}
+	fi, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(base) {
+		t.Errorf("copy has mtime %s, want %s", fi.ModTime(), base)
+	}
+}
+
+func TestFormatRemaining(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		20 * time.Second:                           "<1 min",
+		43*time.Minute + 10*time.Second:            "~43 min",
+		2 * time.Hour:                              "~2 h",
+		time.Hour + 4*time.Minute + 40*time.Second: "~1 h 5 min",
+	} {
+		if got := formatRemaining(d); got != want {
+			t.Errorf("formatRemaining(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestChecksumDB(t *testing.T) {
+	root := makeTree(t, entry{"x.jpg", 10, 0})
+	path := filepath.Join(root, "x.jpg")
+	dbPath := filepath.Join(t.TempDir(), "checksums.json")
+	db, err := openChecksumDB(dbPath, "zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := db.hash(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = openChecksumDB(dbPath, "zstd"); err != nil {
+		t.Fatal(err)
+	}
+	// Changing the content behind the cache's back goes unnoticed...
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, base, base); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.hash(path, false); err != nil || got != want {
+		t.Errorf("hash() = %s, %v; want the cached %s", got, err, want)
+	}
+	// ...unless the hash is fresh or the mtime changes.
+	if got, err := db.hash(path, true); err != nil || got == want {
+		t.Errorf("fresh hash() = %s, %v; want a new one", got, err)
+	}
+	if err := os.Chtimes(path, base, base.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.hash(path, false); err != nil || got == want {
+		t.Errorf("hash() after touching = %s, %v; want a new one", got, err)
+	}
+}
+
+func TestMostRecentEqualMtimes(t *testing.T) {
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("bulk/%02d.jpg", i))
+	}
+	want = want[:13]
+	for run := 0; run < 10; run++ {
+		var files []*file
+		for i := 0; i < 20; i++ {
+			files = append(files, newFile(fmt.Sprintf("bulk/%02d.jpg", i), 10, time.Hour))
+		}
+		// Whatever order the scan comes up with.
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		kept, _, err := testRunner().mostRecent(files, 135)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(kept); !slices.Equal(got, want) {
+			t.Fatalf("kept = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestBalanced(t *testing.T) {
+	quietLogs(t)
+	var files []*file
+	for i := 0; i < 2; i++ {
+		files = append(files, newFile(fmt.Sprintf("card1/%d.jpg", i), 10, 100*time.Hour))
+	}
+	for i := 0; i < 10; i++ {
+		files = append(files, newFile(fmt.Sprintf("card2/%d.jpg", i), 10, time.Duration(i+1)*time.Hour))
+		files = append(files, newFile(fmt.Sprintf("card3/%d.jpg", i), 10, time.Duration(i+50)*time.Hour))
+	}
+	for _, tc := range []struct {
+		by   string
+		want []string
+	}{
+		// card1 needs only 20 of its 26, the rest is split between the two
+		// others.
+		{"equal", []string{"card2/0.jpg", "card2/1.jpg", "card2/2.jpg", "card3/0.jpg", "card3/1.jpg", "card3/2.jpg", "card1/0.jpg", "card1/1.jpg"}},
+		// 7, 36 and 36 of 80.
+		{"size", []string{"card2/0.jpg", "card2/1.jpg", "card2/2.jpg", "card3/0.jpg", "card3/1.jpg", "card3/2.jpg"}},
+	} {
+		r := testRunner()
+		r.BalanceDirs = tc.by
+		kept, skipped, err := r.balanceDirs(slices.Clone(files), 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(kept); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: kept = %q, want %q", tc.by, got, tc.want)
+		}
+		if len(kept)+len(skipped) != len(files) {
+			t.Errorf("%s: %d kept and %d skipped of %d files", tc.by, len(kept), len(skipped), len(files))
+		}
+	}
+}
+
+func TestRemoteDst(t *testing.T) {
+	for dir, want := range map[string][2]string{
+		"pi:/backup":         {"pi", "/backup"},
+		"me@pi.local:photos": {"me@pi.local", "photos"},
+		"pi:":                {"pi", "."},
+		"/media/x:y":         {},
+		"./a:b":              {},
+		"photos":             {},
+		":photos":            {},
+	} {
+		host, path, ok := remoteDst(dir)
+		if ok != (want[0] != "") || host != want[0] || path != want[1] {
+			t.Errorf("remoteDst(%q) = %q, %q, %v; want %q, %q", dir, host, path, ok, want[0], want[1])
+		}
+	}
+}
+
+func TestParseEpoch(t *testing.T) {
+	for s, want := range map[string]time.Time{
+		"1685620800.1234567890": time.Unix(1685620800, 123456789),
+		"1685620800.5":          time.Unix(1685620800, 500000000),
+		"1685620800":            time.Unix(1685620800, 0),
+	} {
+		if got, err := parseEpoch(s); err != nil || !got.Equal(want) {
+			t.Errorf("parseEpoch(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	files := flatten([]*file{
+		newFile("trip/b/IMG_1.jpg", 1, 0),
+		newFile("IMG_1.jpg", 1, 0),
+		newFile("trip/a/IMG_1.jpg", 1, 0),
+		newFile("other/a/img_1.JPG", 1, 0),
+		newFile("x.jpg", 1, 0),
+	})
+	var got []string
+	for _, f := range files {
+		got = append(got, f.path()+" <- "+filepath.ToSlash(f.srcPath()))
+	}
+	want := []string{
+		"IMG_1_b.jpg <- trip/b/IMG_1.jpg",
+		"IMG_1.jpg <- IMG_1.jpg",
+		"IMG_1_a_2.jpg <- trip/a/IMG_1.jpg",
+		"img_1_a.JPG <- other/a/img_1.JPG",
+		"x.jpg <- x.jpg",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("flatten() = %q, want %q", got, want)
+	}
+}
+
+func TestOrganizeByDate(t *testing.T) {
+	shot := func(path string, taken time.Time) *file {
+		f := newFile(path, 1, 0)
+		f.captureTime, f.exif = taken, true
+		return f
+	}
+	june := time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC)
+	files := organizeByDate([]*file{
+		shot("b/IMG_1.jpg", june),
+		shot("a/IMG_1.jpg", june.Add(time.Hour)),
+		shot("a/IMG_2.jpg", june.AddDate(0, 1, 0)),
+		newFile("scan.png", 1, 0),
+	})
+	var got []string
+	for _, f := range files {
+		got = append(got, filepath.ToSlash(f.path())+" <- "+filepath.ToSlash(f.srcPath()))
+	}
+	want := []string{
+		"2024/06/IMG_1_2.jpg <- b/IMG_1.jpg",
+		"2024/06/IMG_1.jpg <- a/IMG_1.jpg",
+		"2024/07/IMG_2.jpg <- a/IMG_2.jpg",
+		"unknown/scan.png <- scan.png",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("organizeByDate() = %q, want %q", got, want)
+	}
+}
+
+func TestCheckNesting(t *testing.T) {
+	root := t.TempDir()
+	for _, tc := range []struct {
+		src   string
+		dst   []string
+		valid bool
+	}{
+		{"src", []string{"dst"}, true},
+		{"src", []string{"src-copy", "pi:src"}, true},
+		{"src", []string{"src/dst"}, false},
+		{"src/a", []string{"src"}, false},
+		{"src", []string{"src/"}, false},
+		{"src", []string{"a", "a/b"}, false},
+	} {
+		r := testRunner()
+		r.Src = filepath.Join(root, tc.src)
+		for _, d := range tc.dst {
+			if !isRemote(d) {
+				d = filepath.Join(root, d)
+			}
+			r.Dst = append(r.Dst, d)
+		}
+		if err := r.checkNesting(); (err == nil) != tc.valid {
+			t.Errorf("checkNesting() of %s and %q = %v, want valid: %v", tc.src, tc.dst, err, tc.valid)
+		}
+	}
+}
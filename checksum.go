@@ -0,0 +1,129 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checksumDB is the cache of file hashes in --checksum-db, so that files
+// which haven't changed since they were last hashed don't need to be read
+// again. An entry only holds while the file keeps its size and mtime.
+type checksumDB struct {
+	path        string
+	compression string // of the file, with --manifest-compression
+
+	mu      sync.Mutex
+	entries map[string]checksumEntry // by absolute path
+	hits    int
+	dirty   bool
+}
+
+type checksumEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// openChecksumDB reads the cache at path, which is empty if it doesn't exist
+// yet, and is saved compressed with compression.
+func openChecksumDB(path, compression string) (*checksumDB, error) {
+	db := &checksumDB{path: path, compression: compression, entries: make(map[string]checksumEntry)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return db, nil
+		}
+		return nil, err
+	}
+	if b, err = decompress(b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &db.entries); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// save writes the cache back if it has changed, dropping the entries of the
+// files which are gone.
+func (db *checksumDB) save() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for path := range db.entries {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			delete(db.entries, path)
+			db.dirty = true
+		}
+	}
+	if db.hits > 0 {
+		log.Printf("Reused %d hashes from %s\n", db.hits, db.path)
+	}
+	if !db.dirty {
+		return nil
+	}
+	b, err := json.Marshal(db.entries)
+	if err != nil {
+		return err
+	}
+	if b, err = compress(b, db.compression); err != nil {
+		return err
+	}
+	return writeFile(db.path, b, 0644)
+}
+
+// hash returns the hash of the file at path, reading it only if fresh is set
+// or the cache has no entry matching its size and mtime.
+func (db *checksumDB) hash(path string, fresh bool) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	db.mu.Lock()
+	e, ok := db.entries[abs]
+	hit := ok && !fresh && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+	if hit {
+		db.hits++
+	}
+	db.mu.Unlock()
+	if hit {
+		return e.Hash, nil
+	}
+	h, err := hashFile(abs)
+	if err != nil {
+		return "", err
+	}
+	db.mu.Lock()
+	db.entries[abs] = checksumEntry{Size: fi.Size(), ModTime: fi.ModTime(), Hash: h}
+	db.dirty = true
+	db.mu.Unlock()
+	return h, nil
+}
+
+// hash returns the hash of the file at path, from --checksum-db if it is
+// set and knows the file as it is.
+func (r *runner) hash(path string) (string, error) {
+	if r.checksums == nil {
+		return hashFile(path)
+	}
+	return r.checksums.hash(path, false)
+}
+
+// rehash is hash, except that the file is always read, for when its content
+// is what's in question, as when verifying a copy. The result still goes to
+// --checksum-db.
+func (r *runner) rehash(path string) (string, error) {
+	if r.checksums == nil {
+		return hashFile(path)
+	}
+	return r.checksums.hash(path, true)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listVar defines a flag which can be repeated to build up the list p.
+func listVar(p *[]string, name, usage string) {
+	flag.Var((*stringList)(p), name, usage)
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// byteSize is a flag.Value accepting human-readable sizes such as "2GiB".
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func sizeVar(p *int64, name, usage string) {
+	flag.Var((*byteSize)(p), name, usage)
+}
+
+// timeValue is a flag.Value accepting RFC3339 times or local dates.
+type timeValue time.Time
+
+func (t *timeValue) String() string {
+	if time.Time(*t).IsZero() {
+		return ""
+	}
+	return time.Time(*t).Format(time.RFC3339)
+}
+
+func (t *timeValue) Set(s string) error {
+	if s == "" {
+		*t = timeValue{}
+		return nil
+	}
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if v, err = time.ParseInLocation(time.DateOnly, s, time.Local); err != nil {
+			return fmt.Errorf("invalid time %q: want RFC3339 or YYYY-MM-DD", s)
+		}
+	}
+	*t = timeValue(v)
+	return nil
+}
+
+func timeVar(p *time.Time, name, usage string) {
+	flag.Var((*timeValue)(p), name, usage)
+}
+
+// commaList is a flag.Value setting a list to comma separated values.
+type commaList []string
+
+func (l *commaList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *commaList) Set(s string) error {
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+func commaVar(p *[]string, name, usage string) {
+	flag.Var((*commaList)(p), name, usage)
+}
+
+// intList is a flag.Value setting a list to comma separated integers.
+type intList []int
+
+func (l *intList) String() string {
+	var s []string
+	for _, n := range *l {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intList) Set(s string) error {
+	*l = nil
+	if s == "" {
+		return nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return fmt.Errorf("invalid number %q", f)
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// confirmValue is a flag.Value for catalog.Config.Confirm which can be given
+// without a value like a bool flag: --confirm is "auto", --confirm=false is
+// "" and --confirm=always is "always".
+type confirmValue string
+
+func (c *confirmValue) String() string {
+	switch *c {
+	case "":
+		return "false"
+	case "auto":
+		return "true"
+	}
+	return string(*c)
+}
+
+func (c *confirmValue) Set(s string) error {
+	if s == "always" {
+		*c = "always"
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("want true, false or always, got %q", s)
+	}
+	*c = ""
+	if b {
+		*c = "auto"
+	}
+	return nil
+}
+
+func (c *confirmValue) IsBoolFlag() bool { return true }
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1e3,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1e6,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1e9,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1e12,
+}
+
+// parseSize parses sizes like "1024", "1.5GiB" or "500MB". Single letter
+// units (K, M, G, T) are binary.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("invalid size %q: must not be negative", s)
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || '9' < r) && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mult, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, s[i:])
+	}
+	if n*mult >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(n * mult), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"1024":    1024,
+		"0":       0,
+		"1.5GiB":  3 << 29,
+		"500MB":   500e6,
+		"2 k":     2048,
+		" 10KiB ": 10240,
+		"1T":      1 << 40,
+	} {
+		if got, err := parseSize(s); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "GiB", "1.2.3", "10 parsecs", "9000000TiB"} {
+		if got, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	var n int64
+	b := (*byteSize)(&n)
+	if err := b.Set("2MiB"); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2<<20 || b.String() != "2097152" {
+		t.Errorf("Set(2MiB) = %d (%s), want 2097152", n, b)
+	}
+	// As flag.FlagSet.PrintDefaults and the --config jobs reset it.
+	if err := b.Set(b.String()); err != nil || n != 2<<20 {
+		t.Errorf("Set(%q) = %d, %v, want 2097152", b, n, err)
+	}
+	if err := b.Set("lots"); err == nil {
+		t.Error("Set(lots) succeeded")
+	}
+}
+
+func TestIntList(t *testing.T) {
+	l := intList{1}
+	if err := l.Set("23, 24"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{23, 24}; !slices.Equal(l, want) || l.String() != "23,24" {
+		t.Errorf("Set(23, 24) = %v (%s), want %v", l, l.String(), want)
+	}
+	if err := l.Set(""); err != nil || l != nil {
+		t.Errorf("Set() = %v, %v, want an empty list", l, err)
+	}
+	if err := l.Set("23,x"); err == nil {
+		t.Error("Set(23,x) succeeded")
+	}
+}
+
+func TestCommaList(t *testing.T) {
+	l := commaList{".*"}
+	if err := l.Set("Thumbs.db,@eaDir"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Thumbs.db", "@eaDir"}; !slices.Equal(l, want) || l.String() != "Thumbs.db,@eaDir" {
+		t.Errorf("Set(Thumbs.db,@eaDir) = %q (%s), want %q", l, l.String(), want)
+	}
+	// Replaces rather than adds to the list, unlike stringList.
+	if err := l.Set(""); err != nil || l != nil {
+		t.Errorf("Set() = %q, %v, want an empty list", l, err)
+	}
+}
+
+// parseFlags parses args as the command line into fresh flags, as if the
+// command was run with them, putting the flags and their values back after
+// the test.
+func parseFlags(t *testing.T, args ...string) {
+	t.Helper()
+	old, saved, savedSrcs := flag.CommandLine, cfg, srcs
+	savedVars := []bool{*verbose, *noSkipSystemFiles, *printCutoff, *update}
+	savedPaths := []string{*configPath, *job}
+	t.Cleanup(func() {
+		flag.CommandLine, cfg, srcs = old, saved, savedSrcs
+		*verbose, *noSkipSystemFiles, *printCutoff, *update = savedVars[0], savedVars[1], savedVars[2], savedVars[3]
+		*configPath, *job = savedPaths[0], savedPaths[1]
+	})
+	fs := flag.NewFlagSet("catalog", flag.ContinueOnError)
+	old.VisitAll(func(f *flag.Flag) {
+		// Leaving out those of the test binary.
+		if !strings.HasPrefix(f.Name, "test.") {
+			fs.Var(f.Value, f.Name, f.Usage)
+			fs.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	flag.CommandLine = fs
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyShortFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args           []string
+		job            map[string]any
+		quiet, verbose bool
+	}{
+		{[]string{"-q"}, nil, true, false},
+		{[]string{"--quiet"}, nil, true, false},
+		{[]string{"-v"}, nil, false, true},
+		{[]string{"--verbose"}, nil, false, true},
+		{nil, map[string]any{"verbose": true}, false, true},
+		{[]string{"-q"}, map[string]any{"quiet": false}, true, false},
+	} {
+		parseFlags(t, append([]string{"--config=jobs.json"}, tc.args...)...)
+		job := map[string]any{"name": "photos"}
+		for k, v := range tc.job {
+			job[k] = v
+		}
+		if err := apply(job, explicitFlags()); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Quiet != tc.quiet || *verbose != tc.verbose {
+			t.Errorf("%q with job %v: quiet=%v verbose=%v, want %v and %v", tc.args, tc.job, cfg.Quiet, *verbose, tc.quiet, tc.verbose)
+		}
+	}
+	parseFlags(t)
+	if err := apply(map[string]any{"name": "photos", "q": true}, explicitFlags()); err == nil {
+		t.Error("apply() took a short flag")
+	}
+}
+
+func TestApplyLists(t *testing.T) {
+	parseFlags(t, "--exclude=*.tmp")
+	job := map[string]any{
+		"name":           "photos",
+		"preserve":       []any{"mode", "times"},
+		"rsync-ok-codes": []any{json.Number("23"), json.Number("24")},
+		"include":        []any{"*.jpg", "*.mov"},
+		"exclude":        []any{"*.xmp"},
+	}
+	if err := apply(job, explicitFlags()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"mode", "times"}; !slices.Equal(cfg.Preserve, want) {
+		t.Errorf("Preserve = %q, want %q", cfg.Preserve, want)
+	}
+	if want := []int{23, 24}; !slices.Equal(cfg.RsyncOKCodes, want) {
+		t.Errorf("RsyncOKCodes = %v, want %v", cfg.RsyncOKCodes, want)
+	}
+	if want := []string{"*.jpg", "*.mov"}; !slices.Equal(cfg.Include, want) {
+		t.Errorf("Include = %q, want %q", cfg.Include, want)
+	}
+	// Given on the command line.
+	if want := []string{"*.tmp"}; !slices.Equal(cfg.Exclude, want) {
+		t.Errorf("Exclude = %q, want %q", cfg.Exclude, want)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	f := flag.Lookup("update")
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+		t.Error("--update needs a value")
+	}
+	for _, tc := range []struct {
+		args []string
+		job  map[string]any // nil without --config
+		want string         // OverwritePolicy, or "" for a conflict
+	}{
+		{[]string{"--update"}, nil, "newer"},
+		{[]string{"--update", "--overwrite-policy=newer"}, nil, "newer"},
+		{[]string{"--update", "--overwrite-policy=changed"}, nil, ""},
+		{[]string{"--overwrite-policy=never", "--update"}, nil, ""},
+		{[]string{"--update"}, map[string]any{}, "newer"},
+		{nil, map[string]any{"update": true}, "newer"},
+		{nil, map[string]any{"update": false}, "changed"},
+		{nil, map[string]any{"update": true, "overwrite-policy": "newer"}, "newer"},
+		{nil, map[string]any{"update": true, "overwrite-policy": "changed"}, ""},
+		{nil, map[string]any{"update": true, "overwrite-policy": "size"}, ""},
+		{[]string{"--overwrite-policy=never"}, map[string]any{"update": true}, ""},
+		{[]string{"--update"}, map[string]any{"overwrite-policy": "always"}, ""},
+		{[]string{"--update=false", "--overwrite-policy=always"}, map[string]any{"update": true}, "always"},
+	} {
+		parseFlags(t, tc.args...)
+		if tc.job != nil {
+			tc.job["name"] = "photos"
+			if err := apply(tc.job, explicitFlags()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := runConfig(tc.job)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%q with job %v: --overwrite-policy=%s, want a conflict", tc.args, tc.job, c.OverwritePolicy)
+		case tc.want != "" && err != nil:
+			t.Errorf("%q with job %v: %v", tc.args, tc.job, err)
+		case tc.want != "" && c.OverwritePolicy != tc.want:
+			t.Errorf("%q with job %v: --overwrite-policy=%s, want %s", tc.args, tc.job, c.OverwritePolicy, tc.want)
+		}
+	}
+}
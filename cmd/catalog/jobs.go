@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A config file defines jobs, each of which is a set of flag values:
+//
+//	{
+//	  "jobs": [
+//	    {
+//	      "name": "photos",
+//	      "src": "/tank/photos",
+//	      "dst": ["/media/keisuke/PHOTOS_A", "/media/keisuke/PHOTOS_B"],
+//	      "exclude": ["*.xmp"],
+//	      "fill-pct": 90,
+//	      "delete-policy": "trash"
+//	    }
+//	  ]
+//	}
+//
+// Flags given on the command line take precedence over the config.
+type config struct {
+	Jobs []map[string]any `json:"jobs"`
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var c config
+	if err := d.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, j := range c.Jobs {
+		if _, ok := j["name"].(string); !ok {
+			return nil, fmt.Errorf("%s: job #%d has no name", path, i+1)
+		}
+	}
+	return &c, nil
+}
+
+// apply sets the flags to the values of job, leaving the ones in explicit
+// alone. The other flags are reset to their defaults so that nothing carries
+// over from the previous job. The short forms of flags are left to the long
+// ones, which would otherwise be reset by them.
+func apply(job map[string]any, explicit map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := shortFlags[f.Name]; err != nil || ok || explicit[f.Name] {
+			return
+		}
+		if l, ok := f.Value.(*stringList); ok {
+			*l = nil
+		} else if err = f.Value.Set(f.DefValue); err != nil {
+			return
+		}
+		v, ok := job[f.Name]
+		if !ok {
+			return
+		}
+		vs, ok := v.([]any)
+		if !ok {
+			vs = []any{v}
+		} else if _, ok := f.Value.(*stringList); !ok {
+			// Like commaList, the other lists are set all at once.
+			s := make([]string, len(vs))
+			for i, v := range vs {
+				s[i] = fmt.Sprint(v)
+			}
+			vs = []any{strings.Join(s, ",")}
+		}
+		for _, v := range vs {
+			if err = f.Value.Set(fmt.Sprint(v)); err != nil {
+				err = fmt.Errorf("job %s: bad %s: %w", job["name"], f.Name, err)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for k := range job {
+		if long, ok := shortFlags[k]; ok {
+			return fmt.Errorf("job %s: use %q rather than %q", job["name"], long, k)
+		}
+		if k != "name" && flag.Lookup(k) == nil {
+			return fmt.Errorf("job %s: unknown flag %q", job["name"], k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/keisuke/catalog"
+)
+
+// setupLogging makes slog.Default(), which catalog.Run logs through, print
+// at the level set by --quiet and --verbose in the format of --log-format.
+func setupLogging(cfg *catalog.Config) {
+	level := slog.LevelInfo
+	switch {
+	case cfg.Quiet:
+		level = slog.LevelError
+	case *verbose:
+		level = slog.LevelDebug
+	}
+	var h slog.Handler = newTextHandler(level)
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && a.Value.Any() == catalog.LevelSummary {
+					a.Value = slog.StringValue("SUMMARY")
+				}
+				return a
+			},
+		})
+	}
+	// Turns the log.Printf lines into records too.
+	slog.SetDefault(slog.New(h))
+}
+
+// textHandler formats records like catalog always has: the actions as plain
+// lines on stdout, and everything else like the log package, with a time
+// stamp on stderr.
+type textHandler struct {
+	level  slog.Level
+	mu     *sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func newTextHandler(level slog.Level) *textHandler {
+	return &textHandler{level: level, mu: new(sync.Mutex), stdout: os.Stdout, stderr: os.Stderr}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	action := false
+	r.Attrs(func(a slog.Attr) bool {
+		action = a.Key == "action"
+		return !action
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if action {
+		_, err := fmt.Fprintln(h.stdout, r.Message)
+		return err
+	}
+	_, err := fmt.Fprintf(h.stderr, "%s %s\n", r.Time.Format("2006/01/02 15:04:05"), r.Message)
+	return err
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *textHandler) WithGroup(string) slog.Handler { return h }
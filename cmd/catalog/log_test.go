@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/keisuke/catalog"
+)
+
+func TestSetupLogging(t *testing.T) {
+	old, oldVerbose := slog.Default(), *verbose
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+		*verbose = oldVerbose
+	})
+	for _, tc := range []struct {
+		quiet, verbose bool
+		format         string
+		enabled        []slog.Level
+		disabled       []slog.Level
+	}{
+		{false, false, "text", []slog.Level{slog.LevelInfo, catalog.LevelSummary}, []slog.Level{slog.LevelDebug}},
+		{true, false, "text", []slog.Level{slog.LevelError, catalog.LevelSummary}, []slog.Level{slog.LevelInfo, slog.LevelWarn}},
+		{false, true, "text", []slog.Level{slog.LevelDebug, catalog.LevelSummary}, nil},
+		{true, false, "json", []slog.Level{catalog.LevelSummary}, []slog.Level{slog.LevelInfo}},
+		{false, true, "json", []slog.Level{slog.LevelDebug}, nil},
+	} {
+		cfg := catalog.DefaultConfig()
+		cfg.Quiet, cfg.LogFormat = tc.quiet, tc.format
+		*verbose = tc.verbose
+		setupLogging(&cfg)
+		h := slog.Default().Handler()
+		for _, l := range tc.enabled {
+			if !h.Enabled(context.Background(), l) {
+				t.Errorf("quiet=%v verbose=%v %s: %s isn't printed", tc.quiet, tc.verbose, tc.format, l)
+			}
+		}
+		for _, l := range tc.disabled {
+			if h.Enabled(context.Background(), l) {
+				t.Errorf("quiet=%v verbose=%v %s: %s is printed", tc.quiet, tc.verbose, tc.format, l)
+			}
+		}
+	}
+}
+
+func TestTextHandler(t *testing.T) {
+	var stdout, stderr strings.Builder
+	h := &textHandler{level: slog.LevelInfo, mu: new(sync.Mutex), stdout: &stdout, stderr: &stderr}
+	l := slog.New(h)
+	l.Info("copying a.jpg", "action", "copy", "path", "a.jpg")
+	l.Info("Scanned 2 files")
+	l.Debug("Skipping b.jpg", "action", "skip")
+	if got, want := stdout.String(), "copying a.jpg\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	if got := stderr.String(); !strings.HasSuffix(got, " Scanned 2 files\n") || strings.Count(got, "\n") != 1 {
+		t.Errorf("stderr = %q, want a time stamped Scanned 2 files", got)
+	}
+}
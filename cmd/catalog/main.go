@@ -0,0 +1,296 @@
+// The catalog command takes the most recent files from src and copies them to
+// dst.
+// $ time go run ./cmd/catalog --src=/tank/photos/ --dst=/media/keisuke/PHOTOS_A/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/keisuke/catalog"
+)
+
+var (
+	configPath = flag.String("config", "", "JSON file defining jobs; see jobs.go")
+	job        = flag.String("job", "", "with --config, the job to run; all of them by default")
+
+	verbose           = flag.Bool("verbose", false, "also print why src files are skipped and the rsync command")
+	noSkipSystemFiles = flag.Bool("no-skip-system-files", false, "take the files of --system-files from src too")
+	update            = flag.Bool("update", false, "only overwrite dst files when src is newer, like rsync --update; short for --overwrite-policy=newer")
+	printCutoff       = flag.Bool("print-cutoff", false, "print the date down to which dst holds src, e.g. 2023-04-11, on stdout at the end; nothing if everything fits")
+)
+
+// shortFlags maps the short forms of flags to the long ones, which they set
+// the same variables as.
+var shortFlags = map[string]string{"q": "quiet", "v": "verbose"}
+
+// cfg is set by the rest of the flags.
+var cfg = catalog.DefaultConfig()
+
+// srcs are the --src flags, which become cfg.Src and cfg.ExtraSrc.
+var srcs []string
+
+func init() {
+	listVar(&srcs, "src", "source directory; repeat to take several, each stored under a directory of dst named after it")
+	listVar(&cfg.Dst, "dst", "destination directory; repeat to distribute the files across several")
+	flag.BoolVar(&cfg.RequireMount, "require-mount", cfg.RequireMount, "fail unless each local --dst is a mount point, not the empty directory an unplugged drive leaves")
+	flag.StringVar(&cfg.ExpectFSType, "expect-fstype", cfg.ExpectFSType, "fail unless each local --dst is on a file system of this type, e.g. exfat or vfat as in mount(8)")
+
+	flag.StringVar(&cfg.Placement, "placement", cfg.Placement, "how to distribute files over multiple --dst: fill-first or balanced")
+
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "output format: text or json")
+	flag.StringVar(&cfg.SummaryJSON, "summary-json", cfg.SummaryJSON, "write the summary of the run to this file as JSON, also when it fails")
+	flag.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "how long to wait for another catalog run on the same dst to finish; 0 to fail right away")
+	flag.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet, "only print errors and the final summaries")
+	flag.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "print what would be done without modifying dst")
+	flag.BoolVar(&cfg.Resume, "resume", cfg.Resume, "carry on with the interrupted run instead of planning again")
+	flag.BoolVar(&cfg.SinceLastRun, "since-last-run", cfg.SinceLastRun, "only scan the src files modified since the last run, keeping what it stored; needs a manifest in each dst")
+	flag.BoolVar(&cfg.Full, "full", cfg.Full, "scan all of src even with --since-last-run")
+	sizeVar(&cfg.Reserve, "reserve", "bytes to leave free on dst, e.g. 2GiB")
+	flag.IntVar(&cfg.FillPct, "fill-pct", cfg.FillPct, "percentage of the dst capacity to fill")
+	flag.BoolVar(&cfg.AccountBlocksize, "account-blocksize", cfg.AccountBlocksize, "count each file as taking whole blocks of the dst file system, which matters for many small files")
+	flag.BoolVar(&cfg.RawBytes, "raw-bytes", cfg.RawBytes, "print sizes as plain byte counts")
+	flag.StringVar(&cfg.SortBy, "sort-by", cfg.SortBy, "what to prioritize files by: mtime, exif (capture date) or size (smallest first; see --after for a recency floor)")
+	flag.DurationVar(&cfg.AlwaysIncludeSince, "always-include-since", cfg.AlwaysIncludeSince, "always keep the src files newer than this, e.g. 720h")
+	flag.IntVar(&cfg.PerDirLimit, "per-dir-limit", cfg.PerDirLimit, "only consider the newest this many files of each src directory; 0 for no limit")
+	flag.StringVar(&cfg.BalanceDirs, "balance-dirs", cfg.BalanceDirs, "split the budget between the top-level directories of src, e.g. one per card, by their total size (size) or equally (equal)")
+	flag.IntVar(&cfg.MaxFiles, "max-files", cfg.MaxFiles, "keep at most this many files; 0 for no limit")
+	flag.IntVar(&cfg.LatestN, "latest-n", cfg.LatestN, "keep exactly this many newest files instead of filling the budget, failing if they don't fit, e.g. for a photo frame holding a number of photos")
+	flag.BoolVar(&cfg.Pack, "pack", cfg.Pack, "skip src files which don't fit instead of stopping, to keep more older files")
+	flag.BoolVar(&cfg.GroupSidecars, "group-sidecars", cfg.GroupSidecars, "keep or skip the files sharing a name but for the extension in a directory together, like IMG_0001.CR2, IMG_0001.JPG and IMG_0001.xmp")
+	flag.StringVar(&cfg.Links, "links", cfg.Links, "what to do with symlinked src files: copy (their targets, the default) or preserve (recreate the links, pointing to the copies of targets within src); broken links are skipped. With rsync, which used to recreate the links, copying without the flag is warned about")
+	flag.BoolVar(&cfg.FollowSymlinks, "follow-symlinks", cfg.FollowSymlinks, "descend into symlinked directories in src and copy link targets")
+	flag.BoolVar(&cfg.OneFileSystem, "one-file-system", cfg.OneFileSystem, "don't descend into directories of src on other file systems, like rsync -x")
+	flag.StringVar(&cfg.SrcList, "src-list", cfg.SrcList, "take the files listed in this file, one path relative to --src per line, instead of walking src")
+	listVar(&cfg.Include, "include", "only take src files matching this glob (repeatable)")
+	listVar(&cfg.Exclude, "exclude", "skip src files matching this glob (repeatable)")
+	flag.StringVar(&cfg.IncludeFrom, "include-from", cfg.IncludeFrom, "read more --include globs from this file, one per line; blank lines and # comments are ignored")
+	flag.StringVar(&cfg.ExcludeFrom, "exclude-from", cfg.ExcludeFrom, "read more --exclude globs from this file, one per line; blank lines and # comments are ignored")
+	flag.BoolVar(&cfg.SkipSystemFiles, "skip-system-files", cfg.SkipSystemFiles, "skip dotfiles and junk like Thumbs.db in src, and leave them alone in dst, see --system-files")
+	commaVar(&cfg.SystemFiles, "system-files", "comma separated globs of the files and directories skipped by --skip-system-files")
+	timeVar(&cfg.After, "after", "only take src files modified at or after this time (RFC3339 or YYYY-MM-DD)")
+	timeVar(&cfg.Before, "before", "only take src files modified before this time (RFC3339 or YYYY-MM-DD)")
+	flag.IntVar(&cfg.MaxDepth, "max-depth", cfg.MaxDepth, "only descend this many directory levels below src, 0 for only the files directly in it; -1 for no limit")
+	flag.DurationVar(&cfg.MinAge, "min-age", cfg.MinAge, "leave out src files modified more recently than this, e.g. 5m, as they may still be being written; they are taken by a later run")
+	sizeVar(&cfg.MinSize, "min-size", "only take src files of at least this size, e.g. 1B to drop empty files")
+	sizeVar(&cfg.MaxSize, "max-size", "only take src files of at most this size, e.g. 500MiB; 0 for no limit")
+
+	flag.BoolVar(&cfg.ReportSkipped, "report-skipped", cfg.ReportSkipped, "report src files which don't fit in dst")
+	flag.BoolVar(&cfg.TreePreview, "tree-preview", cfg.TreePreview, "before changing dst, print the files to be added and removed grouped by directory")
+	flag.IntVar(&cfg.TreePreviewDepth, "tree-preview-depth", cfg.TreePreviewDepth, "how many directory levels --tree-preview groups by, 1 for the top-level ones")
+	flag.BoolVar(&cfg.ByExtension, "by-extension", cfg.ByExtension, "report the number and size of src and kept files by extension")
+	flag.BoolVar(&cfg.StatOnly, "stat-only", cfg.StatOnly, "report the size of src and how much of it fits in dst and exit")
+	flag.StringVar(&cfg.DiffManifest, "diff-manifest", cfg.DiffManifest, "report the src files new, changed and deleted since the run which wrote this manifest, e.g. a copy of the .catalog-manifest.json of a dst which is elsewhere, grouped like --tree-preview, and exit")
+	flag.BoolVar(&cfg.ReportCoverage, "report-coverage", cfg.ReportCoverage, "report how much of src, in files and bytes, is on dst and the dates it covers, and exit")
+	flag.BoolVar(&cfg.ReportDuplicates, "report-duplicates", cfg.ReportDuplicates, "report duplicate files in src and exit")
+	flag.BoolVar(&cfg.HashDuplicates, "hash-duplicates", cfg.HashDuplicates, "with --report-duplicates, also require identical content")
+
+	flag.BoolVar(&cfg.Verify, "verify", cfg.Verify, "check the sizes of the copied files after rsync")
+	flag.BoolVar(&cfg.VerifyHash, "verify-hash", cfg.VerifyHash, "with --verify, also compare the content hashes")
+	flag.IntVar(&cfg.VerifyWorkers, "verify-workers", cfg.VerifyWorkers, "number of files to verify concurrently")
+	flag.IntVar(&cfg.ScanWorkers, "scan-workers", cfg.ScanWorkers, "number of goroutines stat-ing files during scan")
+
+	flag.StringVar(&cfg.PreHook, "pre-hook", cfg.PreHook, "shell command to run before anything else, e.g. to mount dst")
+	flag.StringVar(&cfg.PostHook, "post-hook", cfg.PostHook, "shell command to run after a successful sync, with CATALOG_ADDED, CATALOG_REMOVED, CATALOG_BYTES, CATALOG_PRUNED, CATALOG_SRC, CATALOG_DST and CATALOG_DRY_RUN set")
+	flag.BoolVar(&cfg.PostHookFatal, "post-hook-fatal", cfg.PostHookFatal, "fail the run if --post-hook fails")
+
+	sizeVar(&cfg.MinFreeAfter, "min-free-after", "abort if dst would have less free space than this after the run")
+	flag.BoolVar(&cfg.UseAvail, "use-avail", cfg.UseAvail, "budget against the available space plus the files already in dst instead of the total capacity")
+	flag.BoolVar(&cfg.Progress, "progress", cfg.Progress, "report the overall progress of the copy and a summary at the end")
+	flag.DurationVar(&cfg.ETAInterval, "eta-interval", cfg.ETAInterval, "how often --progress prints the estimated time left; 0 not to")
+	flag.BoolVar(&cfg.Timing, "timing", cfg.Timing, "print how long each phase of the run took at the end: scans, selection, delete, copy, verify and so on")
+	flag.Var((*confirmValue)(&cfg.Confirm), "confirm", "ask before deleting and copying anything, unless stdout isn't a terminal; always to ask regardless")
+
+	flag.StringVar(&cfg.Copier, "copier", cfg.Copier, "how to copy files: rsync or native")
+	flag.DurationVar(&cfg.MtimeTolerance, "mtime-tolerance", cfg.MtimeTolerance, "how far apart mtimes may be while still considered equal")
+	flag.StringVar(&cfg.OverwritePolicy, "overwrite-policy", cfg.OverwritePolicy, "when to overwrite a file already in dst: changed (its size or mtime), always, newer (src is), size (differs) or never")
+	flag.BoolVar(&cfg.CaseInsensitive, "case-insensitive", cfg.CaseInsensitive, "match src and dst paths regardless of case, for a dst which ignores it but isn't detected to (FAT and exFAT are)")
+	listVar(&cfg.KeepDirs, "keep-dirs", "never remove dst directories matching this glob even if empty (repeatable)")
+	commaVar(&cfg.Preserve, "preserve", "comma separated attributes the native copier keeps: mode, times, owner")
+	flag.BoolVar(&cfg.Xattrs, "xattrs", cfg.Xattrs, "copy extended attributes too, like the Finder tags and color labels of macOS, warning if dst can't store them")
+	flag.BoolVar(&cfg.LinkOnly, "link-only", cfg.LinkOnly, "make dst a tree of symlinks to the selected src files instead of copying them, e.g. to try out filters and budgets; sizes are then only informational")
+	flag.BoolVar(&cfg.Hardlink, "hardlink", cfg.Hardlink, "with --link-only, make hard links instead of symlinks; src and dst need to be on the same file system")
+	flag.StringVar(&cfg.OrganizeBy, "organize-by", cfg.OrganizeBy, "store files in dst by exif-date, as YYYY/MM/name by their capture dates or unknown/name without one, numbering those sharing a name; needs --copier=native")
+	flag.StringVar(&cfg.Transcode, "transcode", cfg.Transcode, `shell command writing a smaller version of "$CATALOG_INPUT" to "$CATALOG_OUTPUT" (an existing file of the same extension, so e.g. ffmpeg -y), run instead of copying the files of --transcode-ext; needs --copier=native`)
+	commaVar(&cfg.TranscodeExt, "transcode-ext", "comma separated extensions of the files to --transcode, e.g. mov,mp4")
+	flag.Float64Var(&cfg.TranscodeRatio, "transcode-ratio", cfg.TranscodeRatio, "the share of their size the files to --transcode are expected to take up on dst, until they have been")
+	flag.BoolVar(&cfg.Flatten, "flatten", cfg.Flatten, "store all files in the top directory of dst, renaming those sharing a name; needs --copier=native")
+	commaVar(&cfg.DstProtect, "dst-protect", "comma separated globs of dst files and directories which are left alone and not counted")
+	flag.StringVar(&cfg.DeletePolicy, "delete-policy", cfg.DeletePolicy, "what to do with dst files not selected: mirror (delete), keep, or trash (move to .catalog-trash)")
+	flag.DurationVar(&cfg.PruneSrcOlder, "prune-src-older", cfg.PruneSrcOlder, "after a verified run, delete the src files older than this which weren't selected, e.g. 87600h; needs --i-understand-this-deletes-source")
+	flag.BoolVar(&cfg.SrcDeletesUnderstood, "i-understand-this-deletes-source", cfg.SrcDeletesUnderstood, "allow --prune-src-older to delete files from src")
+	flag.BoolVar(&cfg.NoDelete, "no-delete", cfg.NoDelete, "never remove anything from dst; existing files count against the budget as with --delete-policy=keep")
+	flag.StringVar(&cfg.TrashDir, "trash-dir", cfg.TrashDir, "move removed dst files here, keeping their paths, rather than deleting them")
+	sizeVar(&cfg.TrashMax, "trash-max", "evict the files trashed first once the trash exceeds this; 0 for no limit")
+	flag.IntVar(&cfg.DeleteWorkers, "delete-workers", cfg.DeleteWorkers, "number of files to delete or trash concurrently, which helps on network file systems")
+	flag.BoolVar(&cfg.DeleteKeepGoing, "delete-keep-going", cfg.DeleteKeepGoing, "keep removing the other files when one fails, and fail once all were tried")
+	flag.BoolVar(&cfg.IgnoreErrors, "ignore-errors", cfg.IgnoreErrors, "carry on after errors about single files (unreadable src files, failed deletes and chtimes), listing them at the end and failing then; running out of space still stops the run")
+	flag.BoolVar(&cfg.CopyBeforeDelete, "copy-before-delete", cfg.CopyBeforeDelete, "only delete from dst after the copy succeeded; needs room for both")
+
+	flag.BoolVar(&cfg.Dedup, "dedup", cfg.Dedup, "store files with the same content once in dst, hard linking the others")
+	flag.BoolVar(&cfg.DedupeAcrossSrcDst, "dedupe-across-src-dst", cfg.DedupeAcrossSrcDst, "move or hard link files already in dst under another path, e.g. after reorganizing src, instead of copying them again")
+	flag.BoolVar(&cfg.Checksum, "checksum", cfg.Checksum, "don't copy files whose mtime changed but content didn't, comparing hashes")
+	flag.StringVar(&cfg.ChecksumDB, "checksum-db", cfg.ChecksumDB, "file caching the hashes of --checksum, --verify-hash and --dedup across runs, e.g. on dst")
+	flag.StringVar(&cfg.ManifestCompression, "manifest-compression", cfg.ManifestCompression, "how to compress the manifests and --checksum-db: none, gzip or zstd; any of them is read")
+	sizeVar(&cfg.BWLimit, "bwlimit", "limit the copy to this many bytes per second, e.g. 10MiB; 0 for no limit")
+	flag.IntVar(&cfg.ThreadsPerFile, "threads-per-file", cfg.ThreadsPerFile, "copy each large file in this many ranges at once with --copier=native, for high latency links to dst")
+	sizeVar(&cfg.ThreadsMinSize, "threads-min-size", "the size from which --threads-per-file applies")
+	flag.IntVar(&cfg.Retries, "retries", cfg.Retries, "times to retry deleting, copying or rsync on transient errors")
+	flag.DurationVar(&cfg.RetryDelay, "retry-delay", cfg.RetryDelay, "delay before the first retry, doubling for each next one")
+	flag.StringVar(&cfg.RsyncPath, "rsync-path", cfg.RsyncPath, "rsync binary to use")
+	flag.StringVar(&cfg.RemoteShell, "rsh", cfg.RemoteShell, "remote shell reaching the hosts of --dst given as [user@]host:path, e.g. \"ssh -p 2222\"")
+	flag.StringVar(&cfg.RsyncOpts, "rsync-opts", cfg.RsyncOpts, "space separated rsync options replacing the default -Pav")
+	listVar(&cfg.RsyncFlags, "rsync-flag", "extra argument to pass to rsync (repeatable)")
+	flag.Var((*intList)(&cfg.RsyncOKCodes), "rsync-ok-codes", "comma separated rsync exit codes to only warn about, e.g. 23,24; empty to fail on any")
+
+	flag.BoolVar(&cfg.Quiet, "q", cfg.Quiet, "short for --quiet")
+	flag.BoolVar(verbose, "v", false, "short for --verbose")
+}
+
+// given reports whether the flag name is set on the command line or by job,
+// which is nil without --config.
+func given(job map[string]any, name string) bool {
+	_, ok := job[name]
+	flag.Visit(func(f *flag.Flag) {
+		ok = ok || f.Name == name
+	})
+	return ok
+}
+
+// runConfig returns cfg as adjusted by the flags which aren't part of it,
+// for job.
+func runConfig(job map[string]any) (catalog.Config, error) {
+	c := cfg
+	if len(srcs) > 0 {
+		c.Src, c.ExtraSrc = srcs[0], srcs[1:]
+	}
+	if *noSkipSystemFiles {
+		c.SkipSystemFiles = false
+	}
+	if *update {
+		// Either may come from --config while the other is on the command
+		// line, which takes precedence, so neither can silently win.
+		if p := c.OverwritePolicy; given(job, "overwrite-policy") && p != "newer" {
+			return c, fmt.Errorf("--update conflicts with --overwrite-policy=%s", p)
+		}
+		c.OverwritePolicy = "newer"
+	}
+	return c, nil
+}
+
+// run runs cfg as adjusted by the flags which aren't part of it, for job.
+func run(ctx context.Context, job map[string]any) error {
+	if cfg.Quiet && *verbose {
+		return errors.New("--quiet and --verbose are mutually exclusive")
+	}
+	setupLogging(&cfg)
+	c, err := runConfig(job)
+	if err != nil {
+		return err
+	}
+	s, err := catalog.Run(ctx, c)
+	if (err == nil || len(s.VerifyFailed) > 0 || len(s.Errors) > 0) && !c.StatOnly && !c.ReportDuplicates && !c.ReportCoverage && c.DiffManifest == "" {
+		printSummary(ctx, c, s)
+	}
+	if *printCutoff && err == nil && !s.Cutoff.IsZero() {
+		fmt.Println(s.Cutoff.Format(time.DateOnly))
+	}
+	return err
+}
+
+// printSummary prints the totals of a run over all of its destinations.
+func printSummary(ctx context.Context, c catalog.Config, s catalog.Summary) {
+	msg := "Done: " + s.String()
+	if c.DryRun {
+		msg = "dry run: " + s.String()
+	}
+	slog.Log(ctx, catalog.LevelSummary, msg, "action", "total",
+		"added", s.Added, "added_size", s.Bytes, "removed", s.Removed, "skipped", s.Skipped, "pruned", s.Pruned, "link_only", s.LinkOnly,
+		"cutoff", s.Cutoff, "newest_skipped", s.NewestSkipped, "verify_failed", len(s.VerifyFailed), "errors", len(s.Errors), "duration", s.Duration, "dry_run", c.DryRun)
+}
+
+// runJobs runs the jobs in --config selected by --job.
+func runJobs(ctx context.Context) error {
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	explicit := explicitFlags()
+	ran := false
+	for _, j := range c.Jobs {
+		name := j["name"].(string)
+		if *job != "" && name != *job {
+			continue
+		}
+		if err := apply(j, explicit); err != nil {
+			return err
+		}
+		log.Printf("Running job %s\n", name)
+		if err := run(ctx, j); err != nil {
+			return fmt.Errorf("job %s: %w", name, err)
+		}
+		ran = true
+	}
+	if !ran {
+		return fmt.Errorf("no job %q in %s", *job, *configPath)
+	}
+	return nil
+}
+
+// explicitFlags returns the names of the flags set on the command line,
+// with both forms of those which have a short one.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+		if long, ok := shortFlags[f.Name]; ok {
+			explicit[long] = true
+		}
+	})
+	for short, long := range shortFlags {
+		if explicit[long] {
+			explicit[short] = true
+		}
+	}
+	return explicit
+}
+
+func main() {
+	flag.Parse()
+	// Print the status without interrupting the run.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	cfg.Status = hup
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// Let a second signal kill us right away.
+		<-ctx.Done()
+		stop()
+	}()
+	var err error
+	if *configPath != "" {
+		err = runJobs(ctx)
+	} else {
+		err = run(ctx, nil)
+	}
+	if err != nil {
+		if cfg.LogFormat == "json" {
+			slog.Error(err.Error(), "action", "error")
+		} else {
+			fmt.Println(err)
+		}
+		if errors.Is(err, context.Canceled) {
+			os.Exit(130)
+		}
+		os.Exit(1)
+	}
+}
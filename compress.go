@@ -0,0 +1,67 @@
+package catalog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The magic numbers starting gzip and zstd data, by which decompress tells
+// the formats apart. JSON starts with neither.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compress returns b compressed with the --manifest-compression algo: none,
+// gzip or zstd.
+func compress(b []byte, algo string) ([]byte, error) {
+	switch algo {
+	case "", "none":
+		return b, nil
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algo)
+}
+
+// decompress returns b, decompressed if it is gzip or zstd data, so that
+// files written with any --manifest-compression, plain ones of older
+// versions included, can be read.
+func decompress(b []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case bytes.HasPrefix(b, zstdMagic):
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return r.DecodeAll(b, nil)
+	}
+	return b, nil
+}
@@ -0,0 +1,505 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Config is what Run does. Each field is the command line flag of the same
+// name in kebab case, e.g. FillPct is --fill-pct; see catalog -help. Sizes are
+// in bytes and zero values of the limits mean no limit. Use DefaultConfig
+// rather than the zero Config, which isn't valid.
+type Config struct {
+	Src string
+	// ExtraSrc are the --src flags after the first. With any, the files of
+	// each src directory, Src included, are stored in dst under a directory
+	// named after it, so the directories need different names.
+	ExtraSrc []string
+	Dst      []string
+	// RequireMount refuses a local Dst which isn't a mount point, and
+	// ExpectFSType one on another type of file system, e.g. exfat, so that
+	// a drive which isn't plugged in is noticed.
+	RequireMount bool
+	ExpectFSType string
+
+	Placement string
+
+	LogFormat string
+	// LockWait is how long to wait for another run to release a dst, or 0
+	// to fail with ErrLocked right away.
+	LockWait time.Duration
+	// SummaryJSON is a file to write the Summary of the run to as JSON.
+	SummaryJSON        string
+	Quiet              bool
+	DryRun             bool
+	Resume             bool
+	SinceLastRun       bool
+	Full               bool
+	Reserve            int64
+	FillPct            int
+	AccountBlocksize   bool
+	RawBytes           bool
+	SortBy             string
+	AlwaysIncludeSince time.Duration
+	PerDirLimit        int
+	// BalanceDirs is "" to select over all of src, or "size" or "equal" to
+	// split the budget between its top-level directories by their total
+	// size or equally, and select within each.
+	BalanceDirs string
+	MaxFiles    int
+	// LatestN selects the LatestN newest files instead of filling the
+	// budget, which they still have to fit in.
+	LatestN int
+	Pack    bool
+	// GroupSidecars selects the files sharing a name but for the extension
+	// in a directory, like a RAW, its JPEG and its XMP, as a whole.
+	GroupSidecars  bool
+	FollowSymlinks bool
+	// Links is "copy" to copy the targets of symlinked src files, or
+	// "preserve" to recreate the links on dst. "" is "copy", with a warning
+	// for rsync, which recreated the links before there was a choice.
+	Links         string
+	OneFileSystem bool
+	SrcList       string
+	Include       []string
+	Exclude       []string
+	// IncludeFrom and ExcludeFrom are files of more Include and Exclude
+	// patterns, one per line, with blank lines and # comments left out.
+	IncludeFrom     string
+	ExcludeFrom     string
+	SkipSystemFiles bool
+	SystemFiles     []string
+	After           time.Time
+	Before          time.Time
+	// MaxDepth is how many levels of directories below Src the scan
+	// descends into, 0 for only the files directly in Src, or -1 for no
+	// limit.
+	MaxDepth int
+	// MinAge leaves out the src files modified more recently than this,
+	// which may still be being written.
+	MinAge  time.Duration
+	MinSize int64
+	MaxSize int64
+
+	ReportSkipped bool
+	// TreePreview prints the plan grouped by the directories of dst,
+	// TreePreviewDepth levels deep, before carrying it out.
+	TreePreview      bool
+	TreePreviewDepth int
+	ByExtension      bool
+	StatOnly         bool
+	ReportCoverage   bool
+	// DiffManifest is a manifest to report the changes of src since,
+	// without dst.
+	DiffManifest     string
+	ReportDuplicates bool
+	HashDuplicates   bool
+
+	Verify        bool
+	VerifyHash    bool
+	VerifyWorkers int
+	ScanWorkers   int
+
+	PreHook       string
+	PostHook      string
+	PostHookFatal bool
+
+	MinFreeAfter int64
+	UseAvail     bool
+	Progress     bool
+	// ETAInterval is how often --progress prints the estimated time left,
+	// or 0 not to.
+	ETAInterval time.Duration
+	// Timing prints how long each phase of the run took at the end.
+	Timing bool
+	// Confirm is "" not to ask before changing dst, "auto" to ask if
+	// stdout is a terminal, or "always".
+	Confirm string
+
+	Copier         string
+	MtimeTolerance time.Duration
+	// OverwritePolicy is when a file already in dst is overwritten: if it
+	// "changed" (its size or mtime), "always", if src is "newer", if the
+	// "size" differs, or "never".
+	OverwritePolicy string
+	// CaseInsensitive matches src and dst paths regardless of case, which
+	// is automatic on FAT and exFAT.
+	CaseInsensitive bool
+	KeepDirs        []string
+	Preserve        []string
+	// Xattrs copies extended attributes, like the Finder tags of macOS.
+	Xattrs  bool
+	Flatten bool
+	// OrganizeBy is "exif-date" to store files in YYYY/MM directories by
+	// their capture dates rather than where they are in src.
+	OrganizeBy string
+	// Transcode is a shell command writing a smaller version of the src
+	// file $CATALOG_INPUT to $CATALOG_OUTPUT, run instead of copying the
+	// files with the TranscodeExt extensions. Those count as TranscodeRatio
+	// of their size until they have been transcoded.
+	Transcode      string
+	TranscodeExt   []string
+	TranscodeRatio float64
+	// LinkOnly makes dst a tree of symlinks to the selected src files, or of
+	// hard links with Hardlink, instead of copying them.
+	LinkOnly     bool
+	Hardlink     bool
+	DstProtect   []string
+	DeletePolicy string
+	// NoDelete guarantees that nothing is removed from dst, whatever
+	// DeletePolicy says.
+	NoDelete        bool
+	TrashDir        string
+	TrashMax        int64
+	DeleteWorkers   int
+	DeleteKeepGoing bool
+	// IgnoreErrors carries on after the errors about single files, like
+	// failed deletes or unreadable src files, reporting them at the end.
+	IgnoreErrors     bool
+	CopyBeforeDelete bool
+	// PruneSrcOlder deletes the src files older than this which weren't
+	// selected, after a verified run. It needs SrcDeletesUnderstood.
+	PruneSrcOlder        time.Duration
+	SrcDeletesUnderstood bool
+
+	Dedup bool
+	// DedupeAcrossSrcDst moves or hard links the files already in dst under
+	// another path into place instead of copying them again.
+	DedupeAcrossSrcDst bool
+	Checksum           bool
+	// ChecksumDB is a file caching the hashes of --checksum, --verify-hash
+	// and --dedup for the files which haven't changed since.
+	ChecksumDB string
+	// ManifestCompression is how the manifests and ChecksumDB are
+	// compressed: "none", "gzip" or "zstd". They are read in any of those.
+	ManifestCompression string
+	BWLimit             int64
+	// ThreadsPerFile copies each file of at least ThreadsMinSize in this
+	// many ranges at once, with the native copier.
+	ThreadsPerFile int
+	ThreadsMinSize int64
+	Retries        int
+	RetryDelay     time.Duration
+	RsyncPath      string
+	RsyncOpts      string // space separated
+	RsyncFlags     []string
+	// RemoteShell is the command reaching the hosts of remote Dst
+	// directories, host:path as with rsync, and is passed on to rsync.
+	RemoteShell string
+	// RsyncOKCodes are the rsync exit codes to carry on with, e.g. 24 for
+	// src files which vanished before they could be copied.
+	RsyncOKCodes []int
+
+	// Status isn't a flag: if set, the phase of the run, how far it got and
+	// the estimated time left are printed to stderr whenever it receives,
+	// which the command makes it do on SIGHUP.
+	Status <-chan os.Signal
+}
+
+// DefaultConfig returns the Config of running catalog without flags, to which
+// Src and Dst need to be added.
+func DefaultConfig() Config {
+	return Config{
+		Placement:           "fill-first",
+		LogFormat:           "text",
+		FillPct:             95,
+		SortBy:              "mtime",
+		SkipSystemFiles:     true,
+		SystemFiles:         []string{".*", "Thumbs.db", "ehthumbs.db", "desktop.ini", "@eaDir"},
+		VerifyWorkers:       runtime.NumCPU(),
+		ScanWorkers:         runtime.GOMAXPROCS(0),
+		PostHookFatal:       true,
+		ETAInterval:         time.Minute,
+		Copier:              defaultCopier(),
+		MtimeTolerance:      time.Second,
+		OverwritePolicy:     "changed",
+		Preserve:            []string{"mode", "times"},
+		DstProtect:          []string{manifestName, trashName, ".thumbnails"},
+		DeletePolicy:        "mirror",
+		DeleteWorkers:       1,
+		TreePreviewDepth:    1,
+		TranscodeRatio:      0.3,
+		ManifestCompression: "zstd",
+		MaxDepth:            -1,
+		ThreadsPerFile:      1,
+		ThreadsMinSize:      256 << 20,
+		Retries:             3,
+		RetryDelay:          time.Second,
+		RsyncPath:           "rsync",
+		RsyncOpts:           "-Pav",
+		RemoteShell:         "ssh",
+		RsyncOKCodes:        []int{24},
+	}
+}
+
+// defaultCopier returns the default of --copier.
+func defaultCopier() string {
+	// rsync is rarely installed on Windows.
+	if runtime.GOOS == "windows" {
+		return "native"
+	}
+	return "rsync"
+}
+
+// runner is a run of a Config, holding what it has found out along the way.
+type runner struct {
+	Config
+
+	// block is the largest block size of the destinations with
+	// --account-blocksize, or 0.
+	block int64
+	// bandwidth, if --bwlimit is set, is shared by all the copies.
+	bandwidth *limiter
+
+	// rsync runs rsync, unless a test stands in for it.
+	rsync rsyncRunner
+
+	status status
+
+	// checksums is the --checksum-db cache, if any.
+	checksums *checksumDB
+
+	chownWarning, copyLinksWarning, linkWarning, rangeWarning, xattrWarning sync.Once
+
+	errMu sync.Mutex // guards summary.Errors
+
+	summary Summary
+	timings phases // with --timing
+}
+
+func newRunner(c Config) *runner {
+	c.Src = filepath.Clean(c.Src)
+	c.ExtraSrc = slices.Clone(c.ExtraSrc)
+	for i, s := range c.ExtraSrc {
+		c.ExtraSrc[i] = filepath.Clean(s)
+	}
+	c.Dst = slices.Clone(c.Dst)
+	for i, d := range c.Dst {
+		if !isRemote(d) {
+			c.Dst[i] = filepath.Clean(d)
+		}
+	}
+	r := &runner{Config: c, rsync: execRsync{}}
+	if c.BWLimit > 0 {
+		r.bandwidth = &limiter{rate: c.BWLimit, start: time.Now()}
+	}
+	return r
+}
+
+func (r *runner) check() error {
+	if r.FillPct <= 0 || 100 < r.FillPct {
+		return fmt.Errorf("--fill-pct must be in (0, 100], got %d", r.FillPct)
+	}
+	switch r.SortBy {
+	case "mtime", "exif", "size":
+	default:
+		return fmt.Errorf("--sort-by must be mtime, exif or size, got %q", r.SortBy)
+	}
+	switch r.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("--log-format must be text or json, got %q", r.LogFormat)
+	}
+	if r.Retries < 0 {
+		return fmt.Errorf("--retries must not be negative, got %d", r.Retries)
+	}
+	if r.LatestN < 0 {
+		return fmt.Errorf("--latest-n must not be negative, got %d", r.LatestN)
+	}
+	if r.LatestN > 0 {
+		if r.MaxFiles > 0 || r.Pack || r.PerDirLimit > 0 || r.AlwaysIncludeSince > 0 || r.BalanceDirs != "" {
+			return errors.New("--latest-n can't be used with --max-files, --pack, --per-dir-limit, --always-include-since or --balance-dirs, which are about filling the budget")
+		}
+		if r.SortBy == "size" {
+			return errors.New("--latest-n needs --sort-by=mtime or exif")
+		}
+	}
+	if r.PerDirLimit < 0 {
+		return fmt.Errorf("--per-dir-limit must not be negative, got %d", r.PerDirLimit)
+	}
+	switch r.BalanceDirs {
+	case "", "size", "equal":
+	default:
+		return fmt.Errorf("--balance-dirs must be size or equal, got %q", r.BalanceDirs)
+	}
+	if r.BalanceDirs != "" && (r.MaxFiles > 0 || r.AlwaysIncludeSince > 0) {
+		return errors.New("--balance-dirs can't be used with --max-files or --always-include-since, which apply to all of src")
+	}
+	if r.MaxFiles < 0 {
+		return fmt.Errorf("--max-files must not be negative, got %d", r.MaxFiles)
+	}
+	if r.VerifyWorkers < 1 {
+		return fmt.Errorf("--verify-workers must be positive, got %d", r.VerifyWorkers)
+	}
+	if len(r.Dst) == 0 && !r.ReportDuplicates && !r.StatOnly && r.DiffManifest == "" {
+		return errors.New("--dst is required")
+	}
+	switch r.Copier {
+	case "rsync", "native":
+	default:
+		return fmt.Errorf("--copier must be rsync or native, got %q", r.Copier)
+	}
+	for _, a := range r.Preserve {
+		switch a {
+		case "", "mode", "times", "owner":
+		default:
+			return fmt.Errorf("unknown --preserve attribute %q", a)
+		}
+	}
+	if r.Xattrs && runtime.GOOS == "windows" {
+		return errors.New("--xattrs isn't supported on Windows")
+	}
+	switch r.ManifestCompression {
+	case "none", "gzip", "zstd":
+	default:
+		return fmt.Errorf("--manifest-compression must be none, gzip or zstd, got %q", r.ManifestCompression)
+	}
+	switch r.DeletePolicy {
+	case "mirror", "keep", "trash":
+	default:
+		return fmt.Errorf("--delete-policy must be mirror, keep or trash, got %q", r.DeletePolicy)
+	}
+	if r.TrashDir != "" && r.DeletePolicy == "keep" {
+		return errors.New("--trash-dir can't be used with --delete-policy=keep")
+	}
+	if r.MaxDepth < -1 {
+		return fmt.Errorf("--max-depth must be -1 for no limit or more, got %d", r.MaxDepth)
+	}
+	if r.MinAge < 0 {
+		return fmt.Errorf("--min-age must not be negative, got %s", r.MinAge)
+	}
+	if r.LockWait < 0 {
+		return fmt.Errorf("--lock-wait must not be negative, got %s", r.LockWait)
+	}
+	if r.PruneSrcOlder < 0 {
+		return fmt.Errorf("--prune-src-older must not be negative, got %s", r.PruneSrcOlder)
+	}
+	if r.PruneSrcOlder > 0 && !r.SrcDeletesUnderstood {
+		return errors.New("--prune-src-older deletes files from src and needs --i-understand-this-deletes-source")
+	}
+	if r.PruneSrcOlder > 0 && !r.Verify {
+		return errors.New("--prune-src-older needs --verify, so that only verified runs delete from src")
+	}
+	if r.NoDelete && r.trashing() {
+		return errors.New("--no-delete can't be used with --delete-policy=trash or --trash-dir")
+	}
+	if r.TrashMax != 0 && !r.trashing() {
+		return errors.New("--trash-max needs --trash-dir or --delete-policy=trash")
+	}
+	switch r.Confirm {
+	case "", "auto", "always":
+	default:
+		return fmt.Errorf("--confirm must be true, false or always, got %q", r.Confirm)
+	}
+	switch r.Placement {
+	case "fill-first", "balanced":
+	default:
+		return fmt.Errorf("--placement must be fill-first or balanced, got %q", r.Placement)
+	}
+	switch r.OverwritePolicy {
+	case "changed", "newer", "size", "never":
+	case "always":
+		if r.Checksum {
+			return errors.New("--checksum would skip the unchanged files --overwrite-policy=always copies again")
+		}
+	default:
+		return fmt.Errorf("--overwrite-policy must be changed, always, newer, size or never, got %q", r.OverwritePolicy)
+	}
+	if r.MtimeTolerance < 0 {
+		return fmt.Errorf("--mtime-tolerance must not be negative, got %s", r.MtimeTolerance)
+	}
+	if r.TreePreviewDepth < 1 {
+		return fmt.Errorf("--tree-preview-depth must be positive, got %d", r.TreePreviewDepth)
+	}
+	if r.ThreadsPerFile < 1 {
+		return fmt.Errorf("--threads-per-file must be positive, got %d", r.ThreadsPerFile)
+	}
+	if r.ThreadsPerFile > 1 && r.Copier != "native" {
+		return errors.New("--threads-per-file needs --copier=native")
+	}
+	if r.DeleteWorkers < 1 {
+		return fmt.Errorf("--delete-workers must be positive, got %d", r.DeleteWorkers)
+	}
+	if r.ETAInterval < 0 {
+		return fmt.Errorf("--eta-interval must not be negative, got %s", r.ETAInterval)
+	}
+	if r.ScanWorkers < 1 {
+		return fmt.Errorf("--scan-workers must be positive, got %d", r.ScanWorkers)
+	}
+	if !r.After.IsZero() && !r.Before.IsZero() && r.After.After(r.Before) {
+		return fmt.Errorf("--after (%s) is later than --before (%s)", r.After.Format(time.RFC3339), r.Before.Format(time.RFC3339))
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 {
+		return errors.New("--min-size and --max-size must not be negative")
+	}
+	if r.MaxSize != 0 && r.MinSize > r.MaxSize {
+		return fmt.Errorf("--min-size (%d) is larger than --max-size (%d)", r.MinSize, r.MaxSize)
+	}
+	switch r.Links {
+	case "", "copy":
+	case "preserve":
+		if r.FollowSymlinks {
+			return errors.New("--links=preserve can't be used with --follow-symlinks, which copies link targets")
+		}
+		if r.Verify || r.Checksum || r.Dedup || r.relocating() {
+			return errors.New("--links=preserve can't be used with --verify, --checksum, --dedup, --flatten, --organize-by or several --src")
+		}
+	default:
+		return fmt.Errorf("--links must be copy or preserve, got %q", r.Links)
+	}
+	if r.DedupeAcrossSrcDst && r.LinkOnly {
+		return errors.New("--dedupe-across-src-dst can't be used with --link-only, which doesn't copy anything")
+	}
+	if r.Hardlink && !r.LinkOnly {
+		return errors.New("--hardlink needs --link-only")
+	}
+	switch r.OrganizeBy {
+	case "", "exif-date":
+	default:
+		return fmt.Errorf("--organize-by must be exif-date, got %q", r.OrganizeBy)
+	}
+	if r.Flatten && r.OrganizeBy != "" {
+		return errors.New("--flatten and --organize-by can't be used together")
+	}
+	if r.relocating() && r.Copier != "native" {
+		return errors.New("--flatten, --organize-by and several --src need --copier=native, rsync can't rename the files")
+	}
+	if r.relocating() && r.SinceLastRun {
+		return errors.New("--flatten, --organize-by and several --src can't be used with --since-last-run, which only scans part of src")
+	}
+	if r.Transcode != "" {
+		if len(r.TranscodeExt) == 0 {
+			return errors.New("--transcode needs --transcode-ext to tell which files to transcode")
+		}
+		if r.TranscodeRatio <= 0 || 1 < r.TranscodeRatio {
+			return fmt.Errorf("--transcode-ratio must be in (0, 1], got %g", r.TranscodeRatio)
+		}
+		if r.Copier != "native" {
+			return errors.New("--transcode needs --copier=native")
+		}
+		if r.LinkOnly || r.Verify || r.Checksum || r.Dedup || r.DedupeAcrossSrcDst {
+			return errors.New("--transcode can't be used with --link-only, --verify, --checksum, --dedup or --dedupe-across-src-dst, which need dst to hold the src content")
+		}
+	}
+	if len(r.ExtraSrc) > 0 && r.SrcList != "" {
+		return errors.New("--src-list can't be used with several --src, which it would be relative to")
+	}
+	if err := r.checkRoots(); err != nil {
+		return err
+	}
+	if err := r.checkRemote(); err != nil {
+		return err
+	}
+	for _, p := range append(append(append(slices.Clone(r.Include), r.Exclude...), r.KeepDirs...), r.systemPatterns()...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package catalog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNotConfirmed is returned by Run when the plan wasn't confirmed at the
+// --confirm prompt.
+var ErrNotConfirmed = errors.New("not confirmed, nothing changed")
+
+// isTerminal reports whether f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks on stdin whether to go ahead with the plan of dests, if
+// --confirm says so. It returns ErrNotConfirmed unless the answer is yes.
+func (r *runner) confirm(dests []*destination) error {
+	switch {
+	case r.Confirm == "" || r.DryRun:
+		return nil
+	case r.Confirm == "auto" && !isTerminal(os.Stdout):
+		// Don't block cron.
+		return nil
+	}
+	var add, sub int
+	var addSize, subSize int64
+	for _, d := range dests {
+		add += len(d.add)
+		addSize += totalSize(d.add)
+		if !r.keeping() {
+			sub += len(d.sub)
+			subSize += totalSize(d.sub)
+		}
+	}
+	if add == 0 && sub == 0 {
+		return nil
+	}
+	verb := "deleting"
+	if r.trashing() {
+		verb = "trashing"
+	}
+	// On stderr so that stdout stays the records with --log-format=json.
+	fmt.Fprintf(os.Stderr, "Proceed with %s %d files (%s) and copying %d files (%s)? [y/N] ",
+		verb, sub, r.formatSize(subSize), add, r.formatSize(addSize))
+	return confirmed(os.Stdin)
+}
+
+// confirmed reads an answer from in, returning ErrNotConfirmed unless it is
+// yes.
+func confirmed(in io.Reader) error {
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return ErrNotConfirmed
+}
@@ -0,0 +1,264 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// createTemp creates a file to be renamed to path once written. It is in the
+// same directory, hence on the same file system, so that the rename is atomic.
+func createTemp(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+}
+
+// isTemp reports whether name is that of a temporary file of createTemp or
+// writeLink, which an interrupted copy leaves behind.
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".tmp") || strings.Contains(name, ".tmp."))
+}
+
+// writeFile is os.WriteFile, except that path is replaced atomically: it is
+// either the old or the new content, even if we are interrupted.
+func writeFile(path string, b []byte, perm fs.FileMode) (err error) {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	// Make sure the content is on disk before the rename is.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// copyFile copies the regular file srcPath to dstPath, creating the parent
+// directories as needed (like rsync --mkpath) and preserving the attributes
+// selected by --preserve. The copy is written to a temporary file which
+// replaces dstPath once complete, so that dstPath is never half written, and
+// which is removed on failure.
+func (r *runner) copyFile(srcPath, dstPath string) (err error) {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	out, err := createTemp(dstPath)
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	ranged := false
+	if r.ThreadsPerFile > 1 && fi.Size() >= r.ThreadsMinSize {
+		err := r.copyRanges(out, in, fi.Size(), r.ThreadsPerFile)
+		switch {
+		case err == nil:
+			ranged = true
+		case positionalUnsupported(err):
+			r.rangeWarning.Do(func() {
+				log.Printf("Can't write to %s at offsets (%v), copying large files in one stream\n", filepath.Dir(dstPath), err)
+			})
+		default:
+			out.Close()
+			return err
+		}
+	}
+	// From the start even after a failed copyRanges, which either only got
+	// to extend out or wrote some ranges of in where they belong.
+	if !ranged {
+		if _, err := io.Copy(r.throttle(out), in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	// Make sure the content is on disk before the rename is.
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// CreateTemp leaves it only readable by us, unlike os.Create, which
+	// preserveAttrs may replace with the mode of src.
+	if err := os.Chmod(tmp, createPerm); err != nil {
+		return err
+	}
+	if err := r.preserveAttrs(fi, tmp); err != nil {
+		return err
+	}
+	if r.Xattrs {
+		if err := r.copyXattrs(srcPath, tmp); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dstPath)
+}
+
+// copyRanges copies the size bytes of in to out in n ranges at once, each with
+// positional reads and writes, which keeps a high latency link to dst busier
+// than a single stream does. out is extended to size first.
+func (r *runner) copyRanges(out, in *os.File, size int64, n int) error {
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	chunk := (size + int64(n) - 1) / int64(n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n && int64(i)*chunk < size; i++ {
+		off := int64(i) * chunk
+		wg.Add(1)
+		go func(i int, off, length int64) {
+			defer wg.Done()
+			written, err := io.Copy(r.throttle(io.NewOffsetWriter(out, off)), io.NewSectionReader(in, off, length))
+			if err == nil && written != length {
+				err = fmt.Errorf("%s shrank while being copied", in.Name())
+			}
+			errs[i] = err
+		}(i, off, min(chunk, size-off))
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// positionalUnsupported reports whether err is from a file system which
+// can't extend files or write them at offsets, as with some FUSE ones.
+func positionalUnsupported(err error) bool {
+	for _, target := range []error{errors.ErrUnsupported, syscall.EINVAL, syscall.ESPIPE, syscall.EOPNOTSUPP} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// preserveAttrs gives dstPath the attributes of fi selected by --preserve.
+func (r *runner) preserveAttrs(fi fs.FileInfo, dstPath string) error {
+	atime, _, ok := fileTimes(fi)
+	if !ok {
+		return fmt.Errorf("no stat for %s", fi.Name())
+	}
+	// Chown first as it may clear the setuid and setgid bits.
+	if uid, gid, ok := fileOwner(fi); ok && r.preserves("owner") {
+		if err := os.Chown(dstPath, uid, gid); err != nil {
+			if !errors.Is(err, fs.ErrPermission) {
+				return err
+			}
+			r.chownWarning.Do(func() {
+				log.Printf("Not permitted to change owners (%v), skipping\n", err)
+			})
+		}
+	}
+	if r.preserves("mode") {
+		if err := os.Chmod(dstPath, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if r.preserves("times") {
+		if err := os.Chtimes(dstPath, atime, fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyNative copies d.add to d.dir without rsync, printing the copied files to
+// w.
+func (d *destination) copyNative(ctx context.Context, w io.Writer) error {
+	// With --ignore-errors, the files which couldn't be copied.
+	failed := make(map[*file]bool)
+	// The files not tried after running out of space.
+	var unwritten map[*file]bool
+	var noSpace error
+	for i, f := range d.add {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.DryRun {
+			report("copy", fmt.Sprintf("would copy %s", f.path()), "path", f.path(), "size", f.size, "dry_run", true)
+			continue
+		}
+		srcPath, dstPath := d.srcFile(f.srcPath()), filepath.Join(d.dir, f.path())
+		copy := func() error { return d.copyFile(srcPath, dstPath) }
+		switch {
+		case f.link != "":
+			copy = func() error { return writeLink(f.link, dstPath) }
+		case d.LinkOnly && d.Hardlink:
+			copy = func() error { return writeHardlink(srcPath, dstPath) }
+		case d.LinkOnly:
+			abs, err := filepath.Abs(srcPath)
+			if err != nil {
+				return err
+			}
+			copy = func() error { return writeLink(abs, dstPath) }
+		case d.transcodes(f):
+			copy = func() error { return d.transcode(ctx, srcPath, dstPath) }
+		}
+		if err := d.retry(ctx, srcPath, copy); err != nil {
+			if isNoSpace(err) {
+				// copyFile removed what it wrote, so the rest is all there
+				// is to leave out.
+				unwritten = make(map[*file]bool)
+				for _, f := range d.add[i:] {
+					unwritten[f] = true
+				}
+				noSpace = err
+				break
+			}
+			if err := d.ignore(err); err != nil {
+				return err
+			}
+			failed[f] = true
+			continue
+		}
+		// Print like rsync -v, which is also what progressWriter expects.
+		fmt.Fprintln(w, f.path())
+	}
+	if len(failed) > 0 {
+		// They aren't in dst, for the verification and the manifest.
+		isFailed := func(f *file) bool { return failed[f] }
+		d.add = slices.DeleteFunc(d.add, isFailed)
+		d.keep = slices.DeleteFunc(d.keep, isFailed)
+	}
+	if noSpace != nil {
+		d.outOfSpace(func(f *file) bool { return !unwritten[f] }, "", noSpace)
+	}
+	return nil
+}
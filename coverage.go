@@ -0,0 +1,60 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// reportCoverage prints how much of files, the ones in src, is up to date on
+// any of the destinations, as compare would have it, and the dates covered.
+// It doesn't touch dst.
+func (r *runner) reportCoverage(ctx context.Context, files []*file) error {
+	stored := make(map[*file]bool)
+	for _, dir := range r.Dst {
+		dst, err := r.scanDst(ctx, dir)
+		if err != nil {
+			return err
+		}
+		add, _ := r.compare(files, dst, !isRemote(dir) && isFAT(dir), !isRemote(dir) && foldsCase(dir))
+		missing := make(map[*file]bool)
+		for _, f := range add {
+			missing[f] = true
+		}
+		for _, f := range files {
+			if !missing[f] {
+				stored[f] = true
+			}
+		}
+	}
+	var covered []*file
+	for _, f := range files {
+		if stored[f] {
+			covered = append(covered, f)
+		}
+	}
+	pct := func(n, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(total)
+	}
+	filesPct := pct(int64(len(covered)), int64(len(files)))
+	bytesPct := pct(totalSize(covered), totalSize(files))
+	summary("coverage", fmt.Sprintf("dst holds %.0f%% of src files (%d of %d) and %.0f%% of its bytes (%s of %s)",
+		filesPct, len(covered), len(files), bytesPct, r.formatSize(totalSize(covered)), r.formatSize(totalSize(files))),
+		"files", len(covered), "src_files", len(files), "files_pct", filesPct,
+		"size", totalSize(covered), "src_size", totalSize(files), "size_pct", bytesPct)
+	if len(files) == 0 {
+		return nil
+	}
+	span := func(files []*file) string {
+		if len(files) == 0 {
+			return "nothing"
+		}
+		return oldest(files).Format(time.DateOnly) + " to " + newest(files).Format(time.DateOnly)
+	}
+	summary("coverage-dates", fmt.Sprintf("dst covers %s, src %s", span(covered), span(files)),
+		"oldest", oldest(covered), "newest", newest(covered), "src_oldest", oldest(files), "src_newest", newest(files))
+	return nil
+}
@@ -0,0 +1,141 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// hashDuplicateCandidates sets the hash of the files of src sharing their size
+// with another one, since only those may have the same content.
+func (r *runner) hashDuplicateCandidates(ctx context.Context, files []*file) error {
+	n := make(map[int64]int)
+	for _, f := range files {
+		n[f.size]++
+	}
+	for _, f := range files {
+		if n[f.size] < 2 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h, err := r.hash(r.srcFile(f.srcPath()))
+		if err != nil {
+			return err
+		}
+		f.hash = h
+	}
+	return nil
+}
+
+// link is a file to be stored in a destination as a hard link to another one
+// with the same content.
+type link struct {
+	f, target *file
+}
+
+// planLinks moves the files of d.add with the same content as another file
+// kept in d.dir to d.links.
+func (d *destination) planLinks() error {
+	adding := make(map[string]bool)
+	for _, f := range d.add {
+		adding[f.path()] = true
+	}
+	// The file stored as is for each content.
+	primary := make(map[string]*file)
+	for _, f := range d.keep {
+		if f.hash != "" && !adding[f.path()] && primary[f.hash] == nil {
+			primary[f.hash] = f
+		}
+	}
+	var add []*file
+	for _, f := range d.add {
+		target := primary[f.hash]
+		if f.hash == "" || target == nil {
+			if f.hash != "" {
+				primary[f.hash] = f
+			}
+			add = append(add, f)
+			continue
+		}
+		// A link's mtime is the target's, so compare sees links made by
+		// previous runs as changed.
+		linked, err := sameFile(filepath.Join(d.dir, f.path()), filepath.Join(d.dir, target.path()))
+		if err != nil {
+			return err
+		}
+		if !linked {
+			d.links = append(d.links, link{f, target})
+		}
+	}
+	d.add = add
+	return nil
+}
+
+// sameFile reports whether a and b are the same existing file.
+func sameFile(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	bi, err := os.Stat(b)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(ai, bi), nil
+}
+
+// link creates d.links, copying the files instead if d.dir doesn't support
+// hard links.
+func (d *destination) link(ctx context.Context) error {
+	var linked int
+	var saved int64
+	for _, l := range d.links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(d.dir, l.f.path())
+		target := filepath.Join(d.dir, l.target.path())
+		report("link", fmt.Sprintf("linking %s to %s", path, target), "path", path, "target", target, "size", l.f.size)
+		if d.DryRun {
+			linked++
+			saved += l.f.size
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// Replace an outdated copy.
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			if !errors.Is(err, syscall.EXDEV) && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, errors.ErrUnsupported) {
+				return err
+			}
+			d.linkWarning.Do(func() {
+				log.Printf("Can't hard link in %s (%v), copying duplicates instead\n", d.dir, err)
+			})
+			if err := d.copyFile(d.srcFile(l.f.srcPath()), path); err != nil {
+				return err
+			}
+			continue
+		}
+		linked++
+		saved += l.f.size
+	}
+	if linked > 0 {
+		log.Printf("Hard linked %d duplicate files in %s, saving %s\n", linked, d.dir, d.formatSize(saved))
+	}
+	return nil
+}
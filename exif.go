@@ -0,0 +1,177 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Extensions of the files which may carry EXIF metadata.
+var exifExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".heic": true,
+	".heif": true,
+	".tif":  true,
+	".tiff": true,
+	".dng":  true,
+	".cr2":  true,
+	".cr3":  true,
+	".nef":  true,
+	".arw":  true,
+	".orf":  true,
+	".rw2":  true,
+	".raf":  true,
+	".pef":  true,
+	".srw":  true,
+}
+
+var errNoExif = errors.New("no EXIF data")
+
+const (
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// captureTime returns the DateTimeOriginal EXIF tag of the file at path.
+func captureTime(path string) (time.Time, error) {
+	if !exifExts[strings.ToLower(filepath.Ext(path))] {
+		return time.Time{}, errNoExif
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return time.Time{}, err
+	}
+	switch {
+	case magic[0] == 0xff && magic[1] == 0xd8:
+		return jpegCaptureTime(f)
+	case string(magic[:2]) == "II" || string(magic[:2]) == "MM":
+		// TIFF based RAW formats (CR2, NEF, ARW, DNG, ...).
+		return tiffCaptureTime(f)
+	}
+	// HEIC, CR3 and the like embed an "Exif\0\0" block followed by a TIFF
+	// header somewhere near the beginning. Rather than parsing the container,
+	// look for it in the first MiB.
+	buf := make([]byte, 1<<20)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return time.Time{}, err
+	}
+	buf = buf[:n]
+	for {
+		i := bytes.Index(buf, []byte("Exif\x00\x00"))
+		if i < 0 {
+			return time.Time{}, errNoExif
+		}
+		buf = buf[i+6:]
+		if bytes.HasPrefix(buf, []byte("II*\x00")) || bytes.HasPrefix(buf, []byte("MM\x00*")) {
+			return tiffCaptureTime(bytes.NewReader(buf))
+		}
+	}
+}
+
+func jpegCaptureTime(f *os.File) (time.Time, error) {
+	off := int64(2)
+	for {
+		var hdr [4]byte
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			return time.Time{}, err
+		}
+		if hdr[0] != 0xff {
+			return time.Time{}, fmt.Errorf("malformed JPEG marker at %d", off)
+		}
+		marker := hdr[1]
+		length := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if marker == 0xda { // Start of scan; no more metadata.
+			return time.Time{}, errNoExif
+		}
+		if marker == 0xe1 {
+			var id [6]byte
+			if _, err := f.ReadAt(id[:], off+4); err != nil {
+				return time.Time{}, err
+			}
+			if string(id[:]) == "Exif\x00\x00" {
+				return tiffCaptureTime(io.NewSectionReader(f, off+10, length-8))
+			}
+		}
+		off += 2 + length
+	}
+}
+
+type tiffReader struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+}
+
+func (t *tiffReader) read(off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := t.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// entry returns the type, count and value/offset field of tag in the IFD at
+// off.
+func (t *tiffReader) entry(off int64, tag uint16) (typ uint16, count, value uint32, err error) {
+	b, err := t.read(off, 2)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	n := int(t.order.Uint16(b))
+	b, err = t.read(off+2, n*12)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for i := 0; i < n; i++ {
+		e := b[i*12 : (i+1)*12]
+		if t.order.Uint16(e) == tag {
+			return t.order.Uint16(e[2:]), t.order.Uint32(e[4:]), t.order.Uint32(e[8:]), nil
+		}
+	}
+	return 0, 0, 0, errNoExif
+}
+
+func tiffCaptureTime(r io.ReaderAt) (time.Time, error) {
+	t := &tiffReader{r: r}
+	b, err := t.read(0, 8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return time.Time{}, errNoExif
+	}
+	_, _, exifIFD, err := t.entry(int64(t.order.Uint32(b[4:])), tagExifIFD)
+	if err != nil {
+		return time.Time{}, err
+	}
+	typ, count, value, err := t.entry(int64(exifIFD), tagDateTimeOriginal)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if typ != 2 || count < 19 { // ASCII "YYYY:MM:DD HH:MM:SS\0"
+		return time.Time{}, errNoExif
+	}
+	b, err = t.read(int64(value), 19)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("2006:01:02 15:04:05", string(b), time.Local)
+}
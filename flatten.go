@@ -0,0 +1,87 @@
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// relocating reports whether files are stored elsewhere in dst than in src,
+// with --flatten, --organize-by or several --src.
+func (r *runner) relocating() bool {
+	return r.Flatten || r.OrganizeBy != "" || len(r.ExtraSrc) > 0
+}
+
+// srcPath returns the path of f under src, which differs from its path in
+// dst with --flatten or --organize-by.
+func (f *file) srcPath() string {
+	if f.from != "" {
+		return f.from
+	}
+	return f.path()
+}
+
+// flatten returns files as they are stored with --flatten: all in the top
+// directory of dst under their base names. When several files share a base
+// name, all but the first by src path get the name of their parent directory
+// appended, and then a number if that still isn't unique.
+//
+// The names only depend on the set of files, so they stay the same from run
+// to run as long as src keeps the files sharing a name. Adding one which
+// sorts first renames the others.
+func flatten(files []*file) []*file {
+	return relocate(files, func(*file) string { return "." }, true)
+}
+
+// organizeByDate returns files as they are stored with
+// --organize-by=exif-date: in YYYY/MM directories of dst by their capture
+// dates, or in unknown/ for those without EXIF data. Files sharing a name
+// in a directory are numbered like with flatten.
+func organizeByDate(files []*file) []*file {
+	return relocate(files, func(f *file) string {
+		if !f.exif {
+			return "unknown"
+		}
+		return filepath.FromSlash(f.captureTime.Format("2006/01"))
+	}, false)
+}
+
+// relocate returns files moved to the directories of dst given by dirOf.
+// Collisions are resolved in the order of the src paths by appending the
+// name of the parent directory in src with byParent, and then a number.
+func relocate(files []*file, dirOf func(*file) string, byParent bool) []*file {
+	sorted := slices.Clone(files)
+	slices.SortFunc(sorted, func(a, b *file) int {
+		return strings.Compare(a.path(), b.path())
+	})
+	// The names are case insensitive on the file systems of most photo
+	// frames, FAT and exFAT.
+	taken := make(map[string]bool)
+	moved := make(map[*file]*file)
+	for _, f := range sorted {
+		dir, name := dirOf(f), f.base
+		key := func(name string) string { return strings.ToLower(filepath.Join(dir, name)) }
+		if taken[key(name)] {
+			ext := filepath.Ext(f.base)
+			stem := strings.TrimSuffix(f.base, ext)
+			suffix := ""
+			if byParent && f.dir != "." {
+				suffix = "_" + filepath.Base(f.dir)
+				name = stem + suffix + ext
+			}
+			for i := 2; taken[key(name)]; i++ {
+				name = fmt.Sprintf("%s%s_%d%s", stem, suffix, i, ext)
+			}
+		}
+		taken[key(name)] = true
+		g := *f
+		g.dir, g.base, g.from = dir, name, f.path()
+		moved[f] = &g
+	}
+	ret := make([]*file, len(files))
+	for i, f := range files {
+		ret[i] = moved[f]
+	}
+	return ret
+}
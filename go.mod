@@ -2,4 +2,7 @@ module github.com/keisuke/catalog
 
 go 1.21
 
-require golang.org/x/sys v0.14.0 // indirect
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/sys v0.14.0
+)
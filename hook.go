@@ -0,0 +1,57 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// runHook runs the shell command cmd of the hook name with env added to the
+// environment.
+func (r *runner) runHook(ctx context.Context, name, cmd string, env ...string) error {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.CommandContext(ctx, "cmd", "/C", cmd)
+	} else {
+		c = exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	}
+	c.Env = append(os.Environ(), env...)
+	c.Stdout = os.Stdout
+	if r.jsonLogs() {
+		// Keep stdout to the records.
+		c.Stdout = os.Stderr
+	}
+	c.Stderr = os.Stderr
+	log.Printf("Running the %s %s\n", name, cmd)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s %q: %w", name, cmd, err)
+	}
+	return nil
+}
+
+// runPostHook runs --post-hook with r.summary. A failure is only an error
+// with --post-hook-fatal.
+func (r *runner) runPostHook(ctx context.Context) error {
+	if r.PostHook == "" {
+		return nil
+	}
+	err := r.runHook(ctx, "post-hook", r.PostHook,
+		"CATALOG_ADDED="+strconv.Itoa(r.summary.Added),
+		"CATALOG_REMOVED="+strconv.Itoa(r.summary.Removed),
+		"CATALOG_BYTES="+strconv.FormatInt(r.summary.Bytes, 10),
+		"CATALOG_PRUNED="+strconv.Itoa(r.summary.Pruned),
+		"CATALOG_SRC="+strings.Join(r.srcRoots(), string(os.PathListSeparator)),
+		"CATALOG_DST="+strings.Join(r.Dst, string(os.PathListSeparator)),
+		"CATALOG_DRY_RUN="+strconv.FormatBool(r.DryRun),
+	)
+	if err != nil && !r.PostHookFatal {
+		log.Printf("Ignoring the failed %v\n", err)
+		return nil
+	}
+	return err
+}
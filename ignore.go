@@ -0,0 +1,48 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// fatal reports whether err is one to stop at even with --ignore-errors, as
+// the files after it would fail the same way.
+func fatal(err error) bool {
+	if isNoSpace(err) {
+		return true
+	}
+	for _, target := range []error{syscall.EROFS, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignore returns nil if err is about a single file and --ignore-errors is
+// set, recording it in the summary, or err otherwise.
+func (r *runner) ignore(err error) error {
+	if err == nil || !r.IgnoreErrors || fatal(err) {
+		return err
+	}
+	log.Printf("Carrying on after %v\n", err)
+	r.errMu.Lock()
+	r.summary.Errors = append(r.summary.Errors, err.Error())
+	r.errMu.Unlock()
+	return nil
+}
+
+// ignoredErrors reports the errors recorded by ignore at the end of the run
+// and returns an error if there were any.
+func (r *runner) ignoredErrors() error {
+	for _, e := range r.summary.Errors {
+		summary("error", "error: "+e, "error", e)
+	}
+	if n := len(r.summary.Errors); n > 0 {
+		return fmt.Errorf("carried on after %d errors with --ignore-errors", n)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// linkTarget returns the target to recreate the symlink at path under root
+// with on dst. A target within root is made relative to the link, so that the
+// copy points to the copy of the target, and any other one absolute, so that
+// it keeps pointing to the same file.
+func linkTarget(root, path string) (string, error) {
+	t, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(t) {
+		t = filepath.Join(filepath.Dir(path), t)
+	}
+	t = filepath.Clean(t)
+	if rel, err := filepath.Rel(root, t); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return t, nil
+	}
+	return filepath.Rel(filepath.Dir(path), t)
+}
+
+// writeLink makes dstPath a symlink to target, creating the parent
+// directories as needed. Like copyFile, it replaces whatever is at dstPath
+// atomically.
+func writeLink(target, dstPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".link.tmp")
+	// Left over from an interrupted run, if it exists.
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dstPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeHardlink is writeLink for a hard link to srcPath, which needs to be on
+// the same file system.
+func writeHardlink(srcPath, dstPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".link.tmp")
+	os.Remove(tmp)
+	if err := os.Link(srcPath, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dstPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockName is the file in each dst which a run holds the lock of, so that
+// two runs don't sync the same dst at once.
+const lockName = ".catalog.lock"
+
+// ErrLocked is returned by Run when another run holds the lock of a dst for
+// longer than --lock-wait.
+var ErrLocked = errors.New("another catalog run is in progress")
+
+// lockDsts takes the locks of the local destinations, returning the function
+// releasing them. Remote ones aren't locked.
+//
+// The locks are flock(2) style ones, which the system releases when the
+// process goes away, however that happens.
+func (r *runner) lockDsts(ctx context.Context) (unlock func(), err error) {
+	var files []*os.File
+	unlock = func() {
+		for _, f := range files {
+			unlockFile(f)
+			f.Close()
+		}
+	}
+	for _, dir := range r.Dst {
+		if isRemote(dir) {
+			continue
+		}
+		f, err := r.lock(ctx, dir)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return unlock, nil
+}
+
+// lock takes the lock of dir, waiting up to --lock-wait for another run to
+// release it.
+func (r *runner) lock(ctx context.Context, dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(r.LockWait)
+	for waited := false; ; waited = true {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return f, nil
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+		}
+		if !waited {
+			log.Printf("Waiting up to %s for another catalog run on %s\n", r.LockWait, dir)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(min(time.Second, time.Until(deadline))):
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package catalog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Run logs through slog.Default(), and so does the log package, which it
+// uses for its informational lines. The records of what it does on dst have
+// an "action" attribute, which the catalog command prints as plain lines.
+
+// LevelSummary is the level of the final summaries, which even --quiet keeps.
+const LevelSummary = slog.LevelError + 4
+
+func (r *runner) jsonLogs() bool {
+	return r.LogFormat == "json"
+}
+
+// report logs msg about action, with attrs, which are key-value pairs as with
+// slog.
+func report(action, msg string, attrs ...any) {
+	slog.Info(msg, append([]any{"action", action}, attrs...)...)
+}
+
+// summary is report for the final summaries.
+func summary(action, msg string, attrs ...any) {
+	slog.Log(context.Background(), LevelSummary, msg, append([]any{"action", action}, attrs...)...)
+}
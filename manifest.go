@@ -0,0 +1,206 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestName is the file in each destination describing what it holds.
+const manifestName = ".catalog-manifest.json"
+
+type manifest struct {
+	Time    time.Time       `json:"time"`
+	Src     string          `json:"src"`
+	FillPct int             `json:"fill_pct"`
+	Reserve int64           `json:"reserve"`
+	Budget  int64           `json:"budget"`
+	Files   []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// From is the path in src with --flatten or --organize-by.
+	From string `json:"from,omitempty"`
+}
+
+func manifestPath(f *file) string {
+	return f.path()
+}
+
+func toEntries(files []*file) []manifestEntry {
+	var es []manifestEntry
+	for _, f := range files {
+		es = append(es, manifestEntry{Path: manifestPath(f), Size: f.size, ModTime: f.modTime, From: f.from})
+	}
+	return es
+}
+
+func (r *runner) newManifest(d *destination) *manifest {
+	m := &manifest{
+		Time:    time.Now(),
+		Src:     r.Src,
+		FillPct: r.FillPct,
+		Reserve: r.Reserve,
+		Budget:  d.budget,
+		Files:   toEntries(d.keep),
+	}
+	return m
+}
+
+// readManifest returns the manifest in dir, or nil if there is none.
+func readManifest(dir string) (*manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseManifest(b)
+}
+
+func parseManifest(b []byte) (*manifest, error) {
+	b, err := decompress(b)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// writeManifest writes m to dir compressed with compression, atomically.
+func writeManifest(dir string, m *manifest, compression string) error {
+	b, err := marshalManifest(m, compression)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, manifestName), b, 0644)
+}
+
+func marshalManifest(m *manifest, compression string) ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return compress(b, compression)
+}
+
+// deletedFromSrc returns the entries of m which are no longer in files.
+func deletedFromSrc(m *manifest, files []*file) []manifestEntry {
+	present := make(map[string]bool)
+	for _, f := range files {
+		present[f.srcPath()] = true
+	}
+	var deleted []manifestEntry
+	for _, e := range m.Files {
+		from := e.Path
+		if e.From != "" {
+			from = e.From
+		}
+		if !present[from] {
+			deleted = append(deleted, e)
+		}
+	}
+	return deleted
+}
+
+// diffManifest prints how files changed since the run which wrote the
+// manifest at --diff-manifest, as --tree-preview does: those which are new,
+// those whose size changed and those deleted from src. A file which isn't in
+// the manifest only counts as new if it isn't older than all of those kept
+// then, since the older ones didn't make it and still won't. dst isn't
+// needed, e.g. for a drive which is elsewhere with a copy of its manifest.
+func (r *runner) diffManifest(files []*file) error {
+	b, err := os.ReadFile(r.DiffManifest)
+	if err != nil {
+		return err
+	}
+	m, err := parseManifest(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.DiffManifest, err)
+	}
+	if m.Src != r.Src {
+		log.Printf("%s is of syncing %s, not %s\n", r.DiffManifest, m.Src, r.Src)
+	}
+	stored := make(map[string]manifestEntry)
+	var cutoff time.Time
+	for _, e := range m.Files {
+		stored[e.Path] = e
+		if cutoff.IsZero() || e.ModTime.Before(cutoff) {
+			cutoff = e.ModTime
+		}
+	}
+	var added, changed []*file
+	for _, f := range files {
+		e, ok := stored[manifestPath(f)]
+		switch {
+		case !ok && !f.modTime.Before(cutoff):
+			added = append(added, f)
+		case ok && e.Size != f.size:
+			changed = append(changed, f)
+		}
+	}
+	deleted := fromEntries(deletedFromSrc(m, files))
+	log.Printf("Since the run of %s: %d new files (%s), %d changed (%s), %d deleted from src (%s)\n",
+		m.Time.Format(time.DateTime), len(added), r.formatSize(totalSize(added)),
+		len(changed), r.formatSize(totalSize(changed)), len(deleted), r.formatSize(totalSize(deleted)))
+	r.printTree(r.DiffManifest, added, changed, deleted)
+	return nil
+}
+
+// lastRun returns the time of the previous run to all of --dst and the files
+// it kept there, or the zero time unless each of them has a manifest of
+// syncing --src.
+func (r *runner) lastRun(ctx context.Context) (time.Time, []*file, error) {
+	var since time.Time
+	var kept []*file
+	for _, dir := range r.Dst {
+		m, err := r.readManifestOf(ctx, dir)
+		if err != nil {
+			return time.Time{}, nil, fmt.Errorf("reading the manifest of %s: %w", dir, err)
+		}
+		if m == nil || m.Src != r.Src {
+			log.Printf("No manifest of syncing %s in %s, scanning all of src\n", r.Src, dir)
+			return time.Time{}, nil, nil
+		}
+		if since.IsZero() || m.Time.Before(since) {
+			since = m.Time
+		}
+		kept = append(kept, fromEntries(m.Files)...)
+	}
+	return since, kept, nil
+}
+
+// stillStored returns those of the previously kept files which weren't
+// scanned again and are still in one of dests.
+func stillStored(previous, scanned []*file, dests []*destination) []*file {
+	skip := make(map[string]bool)
+	for _, f := range scanned {
+		skip[f.path()] = true
+	}
+	stored := make(map[string]bool)
+	for _, d := range dests {
+		for _, f := range d.files {
+			stored[f.path()] = true
+		}
+	}
+	var ret []*file
+	for _, f := range previous {
+		if !skip[f.path()] && stored[f.path()] {
+			skip[f.path()] = true
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,63 @@
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// isMountPoint reports whether dir is where a file system is mounted, being
+// on another device than its parent, or the root of one.
+func isMountPoint(dir string) (bool, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return false, err
+	}
+	parent := filepath.Dir(abs)
+	if parent == abs {
+		return true, nil
+	}
+	dev, _, ok := fileID(abs)
+	if !ok {
+		return false, fmt.Errorf("can't stat %s", abs)
+	}
+	parentDev, _, ok := fileID(parent)
+	if !ok {
+		return false, fmt.Errorf("can't stat %s", parent)
+	}
+	return dev != parentDev, nil
+}
+
+// checkMounts returns an error if a local dst isn't a mount point with
+// --require-mount, or isn't on a file system of the --expect-fstype type. A
+// drive which isn't plugged in leaves its empty mount point directory behind,
+// which would otherwise get the whole library on the disk it is on.
+func (r *runner) checkMounts() error {
+	for _, dir := range r.Dst {
+		if isRemote(dir) {
+			continue
+		}
+		if r.RequireMount {
+			ok, err := isMountPoint(dir)
+			if err != nil {
+				return fmt.Errorf("--require-mount: %w", err)
+			}
+			if !ok {
+				return fmt.Errorf("--dst %s is not a mount point, is the drive plugged in?", dir)
+			}
+		}
+		if r.ExpectFSType != "" {
+			typ, err := fsType(dir)
+			if err != nil {
+				return fmt.Errorf("--expect-fstype: %w", err)
+			}
+			if !strings.EqualFold(typ, r.ExpectFSType) {
+				return fmt.Errorf("--dst %s is on %s, not %s, is the drive plugged in?", dir, typ, r.ExpectFSType)
+			}
+		}
+	}
+	return nil
+}
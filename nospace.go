@@ -0,0 +1,51 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ErrNoSpace is returned by Run when a dst ran out of space partway through
+// the copy, despite the budget, as with block overhead or another writer.
+var ErrNoSpace = errors.New("ran out of space")
+
+// noSpaceMessage ends rsync's error about a write which ran out of space, as
+// in `rsync: [receiver] write failed on "...": No space left on device (28)`.
+const noSpaceMessage = "No space left on device"
+
+// outOfSpace leaves the files of d.add for which copied is false out of d.add
+// and d.keep after d.dir ran out of space with err, reporting them, so that
+// the rest of the sync and the manifest go by what is actually there. The file
+// at the path writing, if not "", is removed unless it is complete.
+func (d *destination) outOfSpace(copied func(*file) bool, writing string, err error) {
+	for _, f := range d.add {
+		if f.path() != writing {
+			continue
+		}
+		path := filepath.Join(d.dir, f.path())
+		// rsync -P keeps what it wrote of it.
+		if fi, err := os.Lstat(path); err == nil && fi.Size() != f.size {
+			os.Remove(path)
+		}
+	}
+	var skipped []*file
+	isSkipped := make(map[*file]bool)
+	for _, f := range d.add {
+		if !copied(f) {
+			skipped = append(skipped, f)
+			isSkipped[f] = true
+			report("no-space", fmt.Sprintf("not copied for lack of space: %s", f.path()), "dst", d.dir, "path", f.path(), "size", f.size)
+		}
+	}
+	drop := func(f *file) bool { return isSkipped[f] }
+	d.add = slices.DeleteFunc(d.add, drop)
+	d.keep = slices.DeleteFunc(d.keep, drop)
+	summary("no-space", fmt.Sprintf("%s ran out of space (%v): copied %d files (%s), skipped %d (%s)",
+		d.dir, err, len(d.add), d.formatSize(totalSize(d.add)), len(skipped), d.formatSize(totalSize(skipped))),
+		"dst", d.dir, "error", err.Error(), "copied", len(d.add), "copied_size", totalSize(d.add),
+		"skipped", len(skipped), "skipped_size", totalSize(skipped))
+	d.noSpace = fmt.Errorf("%s: %w: %v", d.dir, ErrNoSpace, err)
+}
@@ -0,0 +1,60 @@
+package catalog
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// readPatterns returns the globs in the file at path, one per line, leaving
+// out blank lines and # comments. Each one is checked, so that a typo fails
+// the run rather than silently matching nothing.
+func readPatterns(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad pattern %q: %w", path, n, line, err)
+		}
+		patterns = append(patterns, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// loadPatterns adds the patterns of --include-from and --exclude-from to those
+// of --include and --exclude.
+func (r *runner) loadPatterns() error {
+	for _, l := range []struct {
+		path     string
+		patterns *[]string
+	}{
+		{r.IncludeFrom, &r.Include},
+		{r.ExcludeFrom, &r.Exclude},
+	} {
+		if l.path == "" {
+			continue
+		}
+		p, err := readPatterns(l.path)
+		if err != nil {
+			return err
+		}
+		// Not to append to the caller's slice.
+		*l.patterns = append(slices.Clip(*l.patterns), p...)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// previewDir returns the directory of dst which f is counted under in the
+// --tree-preview, its directory cut down to --tree-preview-depth levels.
+func (r *runner) previewDir(f *file) string {
+	if f.dir == "." {
+		return "./"
+	}
+	parts := strings.Split(filepath.ToSlash(f.dir), "/")
+	return strings.Join(parts[:min(len(parts), r.TreePreviewDepth)], "/") + "/"
+}
+
+// treePreview prints the plan of d grouped by directory, like
+// "2024/06/  +140 files (3.2 GiB), -5 files (12 MiB)", which is quicker to
+// take in than the files one by one.
+func (d *destination) treePreview() {
+	var sub []*file
+	if !d.keeping() {
+		sub = d.sub
+	}
+	d.printTree(d.dir, d.add, nil, sub)
+}
+
+// printTree prints the files added to, changed in and removed from dst
+// grouped by directory, as with --tree-preview.
+func (r *runner) printTree(dst string, add, changed, sub []*file) {
+	type change struct {
+		added, changed, removed             int
+		addedSize, changedSize, removedSize int64
+	}
+	changes := make(map[string]*change)
+	get := func(f *file) *change {
+		dir := r.previewDir(f)
+		if changes[dir] == nil {
+			changes[dir] = &change{}
+		}
+		return changes[dir]
+	}
+	for _, f := range add {
+		c := get(f)
+		c.added++
+		c.addedSize += f.size
+	}
+	for _, f := range changed {
+		c := get(f)
+		c.changed++
+		c.changedSize += f.size
+	}
+	for _, f := range sub {
+		c := get(f)
+		c.removed++
+		c.removedSize += f.size
+	}
+	dirs := make([]string, 0, len(changes))
+	width := 0
+	for dir := range changes {
+		dirs = append(dirs, dir)
+		width = max(width, len(dir))
+	}
+	slices.Sort(dirs)
+	if len(dirs) == 0 {
+		report("tree", fmt.Sprintf("%s: nothing to change", dst), "dst", dst, "dirs", 0)
+		return
+	}
+	report("tree", fmt.Sprintf("%s: %d directories changing", dst, len(dirs)), "dst", dst, "dirs", len(dirs))
+	for _, dir := range dirs {
+		c := changes[dir]
+		var parts []string
+		if c.added > 0 {
+			parts = append(parts, fmt.Sprintf("+%d files (%s)", c.added, r.formatSize(c.addedSize)))
+		}
+		if c.changed > 0 {
+			parts = append(parts, fmt.Sprintf("~%d files (%s)", c.changed, r.formatSize(c.changedSize)))
+		}
+		if c.removed > 0 {
+			parts = append(parts, fmt.Sprintf("-%d files (%s)", c.removed, r.formatSize(c.removedSize)))
+		}
+		report("tree", fmt.Sprintf("  %-*s  %s", width, dir, strings.Join(parts, ", ")),
+			"dst", dst, "dir", dir, "added", c.added, "added_size", c.addedSize,
+			"changed", c.changed, "changed_size", c.changedSize,
+			"removed", c.removed, "removed_size", c.removedSize)
+	}
+}
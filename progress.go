@@ -0,0 +1,193 @@
+package catalog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// etaMinFiles is how many files need to have been transferred before the
+// throughput is worth estimating the rest from.
+const etaMinFiles = 3
+
+// progressWriter passes rsync's output through to w while counting the
+// planned files rsync reports as transferred, printing the overall progress if
+// --progress is set. rsync -v prints the path of each file relative to src,
+// which is how we recognize them. With --log-format=json, rsync's output is
+// replaced by a record for each of those files, and with --quiet dropped.
+type progressWriter struct {
+	*runner
+
+	w       io.Writer
+	report  bool
+	pending map[string]int64 // sizes of the files not transferred yet
+	total   int              // number of files in the plan
+	size    int64            // bytes in the plan
+	start   time.Time
+
+	mu    sync.Mutex // guards files and bytes, which the ETA reads
+	files int
+	bytes int64
+	buf   []byte
+
+	// done, if set, is called with each file once it has been transferred.
+	// rsync prints the path when it starts on a file, so a file is only known
+	// to be done when the next one starts or rsync exits successfully.
+	done func(path string)
+	last string
+
+	// peak is the highest rate in bytes per second of rsync -P's progress
+	// lines so far.
+	peak float64
+}
+
+func (r *runner) newProgressWriter(w io.Writer, files []*file) *progressWriter {
+	p := &progressWriter{
+		runner:  r,
+		w:       w,
+		report:  r.Progress,
+		pending: make(map[string]int64),
+		total:   len(files),
+		size:    totalSize(files),
+		start:   time.Now(),
+	}
+	for _, f := range files {
+		p.pending[f.path()] = f.size
+	}
+	return p
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	var err error
+	if !p.jsonLogs() && !p.Quiet {
+		n, err = p.w.Write(b)
+	}
+	p.buf = append(p.buf, b...)
+	for {
+		// -P redraws the progress with \r.
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := string(p.buf[:i])
+		p.buf = p.buf[i+1:]
+		size, ok := p.pending[line]
+		if !ok {
+			if rate, ok := parseRsyncRate(line); ok {
+				p.peak = max(p.peak, rate)
+			}
+			continue
+		}
+		delete(p.pending, line)
+		p.finish()
+		p.last = line
+		p.mu.Lock()
+		p.files++
+		p.bytes += size
+		p.mu.Unlock()
+		if p.jsonLogs() {
+			report("copy", "copying "+line, "path", line, "size", size)
+		}
+		if !p.report {
+			continue
+		}
+		if p.jsonLogs() {
+			report("progress", "progress", "files", p.files, "total_files", p.total, "bytes", p.bytes, "total_bytes", p.size)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "progress: %d/%d files, %s/%s, %s\n",
+			p.files, p.total, p.formatSize(p.bytes), p.formatSize(p.size), p.rate(p.bytes, time.Since(p.start)))
+	}
+	return n, err
+}
+
+// finish marks the file being transferred as done.
+func (p *progressWriter) finish() {
+	if p.done != nil && p.last != "" {
+		p.done(p.last)
+	}
+	p.last = ""
+}
+
+// startETA prints the estimated time left every interval until the
+// returned function is called. The estimate is the remaining bytes of the
+// plan at the average throughput so far. rsync only tells when it starts on
+// a file, so its estimates come out somewhat optimistic.
+func (p *progressWriter) startETA(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				p.printETA()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// remaining returns the estimated time left, once etaMinFiles have been
+// transferred.
+func (p *progressWriter) remaining() (time.Duration, bool) {
+	p.mu.Lock()
+	files, bytes := p.files, p.bytes
+	p.mu.Unlock()
+	elapsed := time.Since(p.start)
+	if files < etaMinFiles || bytes == 0 || elapsed <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(p.size-bytes) / float64(bytes) * float64(elapsed)), true
+}
+
+// printETA prints the estimated time left, once etaMinFiles have been
+// transferred.
+func (p *progressWriter) printETA() {
+	left, ok := p.remaining()
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	bytes := p.bytes
+	p.mu.Unlock()
+	if p.jsonLogs() {
+		report("eta", "eta", "remaining", left, "bytes", bytes, "total_bytes", p.size)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "eta: %s remaining, %s / %s\n", formatRemaining(left), p.formatSize(bytes), p.formatSize(p.size))
+}
+
+// formatRemaining formats d roughly, e.g. "~1 h 5 min".
+func formatRemaining(d time.Duration) string {
+	m := int(d.Round(time.Minute) / time.Minute)
+	switch {
+	case m < 1:
+		return "<1 min"
+	case m < 60:
+		return fmt.Sprintf("~%d min", m)
+	case m%60 == 0:
+		return fmt.Sprintf("~%d h", m/60)
+	}
+	return fmt.Sprintf("~%d h %d min", m/60, m%60)
+}
+
+// rate formats the throughput of transferring n bytes in d.
+func (r *runner) rate(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return r.formatSize(int64(float64(n)/d.Seconds())) + "/s"
+}
@@ -0,0 +1,42 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// pruneSrc deletes the files of skipped older than --prune-src-older from
+// src. They are the ones which aged out of dst and won't be selected again.
+// It is only called once everything else succeeded, --verify included.
+func (r *runner) pruneSrc(ctx context.Context, skipped []*file) error {
+	cutoff := time.Now().Add(-r.PruneSrcOlder)
+	var n int
+	var size int64
+	for _, f := range skipped {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !r.key(f).Before(cutoff) {
+			continue
+		}
+		path := r.srcFile(f.srcPath())
+		report("prune-src", fmt.Sprintf("deleting %s from src", path), "path", path, "size", f.size, "dry_run", r.DryRun)
+		if !r.DryRun {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		n++
+		size += f.size
+	}
+	r.summary.Pruned = n
+	if n > 0 {
+		log.Printf("Deleted %d files (%s) older than %s from src\n", n, r.formatSize(size), cutoff.Format(time.DateTime))
+	}
+	return nil
+}
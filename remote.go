@@ -0,0 +1,266 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// remoteDst splits dir into the host and the path on it if it is in rsync's
+// remote shell form, host:path or user@host:path.
+func remoteDst(dir string) (host, dirPath string, ok bool) {
+	i := strings.IndexByte(dir, ':')
+	if i <= 0 || strings.ContainsAny(dir[:i], `/\`) {
+		return "", "", false
+	}
+	// A drive letter, as in C:\photos.
+	if i == 1 && runtime.GOOS == "windows" {
+		return "", "", false
+	}
+	dirPath = dir[i+1:]
+	if dirPath == "" {
+		dirPath = "."
+	}
+	return dir[:i], dirPath, true
+}
+
+// isRemote reports whether dir is on another host, see remoteDst.
+func isRemote(dir string) bool {
+	_, _, ok := remoteDst(dir)
+	return ok
+}
+
+// checkRemote returns an error if an option which needs dst to be local is
+// set along with a remote dst.
+func (r *runner) checkRemote() error {
+	for _, dir := range r.Dst {
+		if !isRemote(dir) {
+			continue
+		}
+		for flag, set := range map[string]bool{
+			"--copier=native":                   r.Copier == "native",
+			"--link-only":                       r.LinkOnly,
+			"--delete-policy=trash/--trash-dir": r.trashing(),
+			"--verify":                          r.Verify,
+			"--checksum":                        r.Checksum,
+			"--dedup":                           r.Dedup,
+			"--dedupe-across-src-dst":           r.DedupeAcrossSrcDst,
+			"--account-blocksize":               r.AccountBlocksize,
+		} {
+			if set {
+				return fmt.Errorf("%s needs a local --dst, got %s", flag, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runRemote runs the shell command script on host through --rsh with stdin,
+// returning what it prints.
+func (r *runner) runRemote(ctx context.Context, host, script string, stdin io.Reader) ([]byte, error) {
+	args := append(strings.Fields(r.RemoteShell), host, script)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s on %s: %w: %s", script, host, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// scanRemote is scan for a remote dst, listing it with GNU find. Only the
+// protect option is supported.
+func (r *runner) scanRemote(ctx context.Context, dir string, opts scanOptions) ([]*file, error) {
+	host, dirPath, _ := remoteDst(dir)
+	out, err := r.runRemote(ctx, host, "cd "+shellQuote(dirPath)+` && find . -type f -printf '%P\t%s\t%T@\0'`, nil)
+	if err != nil {
+		return nil, err
+	}
+	var files []*file
+	for _, line := range strings.Split(string(out), "\x00") {
+		if line == "" {
+			continue
+		}
+		// The path may contain tabs, the rest doesn't.
+		f := strings.Split(line, "\t")
+		if len(f) < 3 {
+			return nil, fmt.Errorf("unexpected find output from %s: %q", dir, line)
+		}
+		rel := strings.Join(f[:len(f)-2], "\t")
+		size, err := strconv.ParseInt(f[len(f)-2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected find output from %s: %q", dir, line)
+		}
+		mtime, err := parseEpoch(f[len(f)-1])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected find output from %s: %q", dir, line)
+		}
+		if leftOut(rel, opts.protect) {
+			continue
+		}
+		p := filepath.FromSlash(rel)
+		files = append(files, &file{dir: filepath.Dir(p), base: filepath.Base(p), size: size, modTime: mtime, captureTime: mtime})
+	}
+	if r.jsonLogs() {
+		report("scan-complete", fmt.Sprintf("Scanned %d files in %s", len(files), dir),
+			"dir", dir, "files", len(files), "size", totalSize(files))
+	}
+	return files, nil
+}
+
+// leftOut reports whether rel, a slash separated path, is one the local scan
+// of dst would have skipped: the manifest, anything in the trash, or under a
+// protected path.
+func leftOut(rel string, protect []string) bool {
+	if rel == manifestName || rel == lockName {
+		return true
+	}
+	for p := rel; p != "."; p = path.Dir(p) {
+		if p == trashName || protected(protect, filepath.FromSlash(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEpoch parses the seconds since the epoch with a fraction, as find's
+// %T@ prints them, without going through a float64 which would lose the
+// nanoseconds.
+func parseEpoch(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	frac = (frac + "000000000")[:9]
+	nsec, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// remoteSpace returns the capacity and the available space of the file
+// system of a remote dir, from df.
+func (r *runner) remoteSpace(ctx context.Context, dir string) (capacity, free int64, err error) {
+	host, dirPath, _ := remoteDst(dir)
+	out, err := r.runRemote(ctx, host, "df -Pk "+shellQuote(dirPath), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	// The file system may have spaces in its name, the numbers come last.
+	var f []string
+	if len(lines) >= 2 {
+		f = strings.Fields(lines[len(lines)-1])
+	}
+	if len(f) < 6 {
+		return 0, 0, fmt.Errorf("unexpected df output from %s: %q", dir, out)
+	}
+	capacity, err = strconv.ParseInt(f[len(f)-5], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected df output from %s: %q", dir, out)
+	}
+	free, err = strconv.ParseInt(f[len(f)-3], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected df output from %s: %q", dir, out)
+	}
+	return capacity * 1024, free * 1024, nil
+}
+
+// capacity returns the size of the file system of dir.
+func (r *runner) capacity(ctx context.Context, dir string) (int64, error) {
+	if !isRemote(dir) {
+		return stat(dir)
+	}
+	c, _, err := r.remoteSpace(ctx, dir)
+	return c, err
+}
+
+// free returns the space available in dir.
+func (r *runner) free(ctx context.Context, dir string) (int64, error) {
+	if !isRemote(dir) {
+		return avail(dir)
+	}
+	_, f, err := r.remoteSpace(ctx, dir)
+	return f, err
+}
+
+// removeRemote deletes d.sub from a remote d.dir in one go, then the
+// directories left empty other than --keep-dirs.
+func (d *destination) removeRemote(ctx context.Context) error {
+	host, dirPath, _ := remoteDst(d.dir)
+	var list bytes.Buffer
+	for _, f := range d.sub {
+		path := d.dir + "/" + filepath.ToSlash(f.path())
+		report("delete", fmt.Sprintf("deleting %s", path), "path", path, "size", f.size)
+		fmt.Fprintf(&list, "%s\x00", filepath.ToSlash(f.path()))
+	}
+	if d.DryRun || len(d.sub) == 0 {
+		return nil
+	}
+	prune := "find . -mindepth 1 -type d -empty"
+	for _, p := range d.KeepDirs {
+		prune += " ! -name " + shellQuote(p)
+	}
+	script := "cd " + shellQuote(dirPath) + " && xargs -0 rm -f -- && " + prune + " -delete"
+	err := d.retry(ctx, "delete on "+host, func() error {
+		_, err := d.runRemote(ctx, host, script, bytes.NewReader(list.Bytes()))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.removed = len(d.sub)
+	d.mu.Unlock()
+	return nil
+}
+
+// readManifestOf is readManifest for a local or remote dir.
+func (r *runner) readManifestOf(ctx context.Context, dir string) (*manifest, error) {
+	if !isRemote(dir) {
+		return readManifest(dir)
+	}
+	host, dirPath, _ := remoteDst(dir)
+	p := shellQuote(path.Join(dirPath, manifestName))
+	out, err := r.runRemote(ctx, host, "if [ -e "+p+" ]; then cat "+p+"; fi", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return parseManifest(out)
+}
+
+// writeManifestOf is writeManifest for a local or remote dir. The remote one
+// is replaced atomically too.
+func (r *runner) writeManifestOf(ctx context.Context, dir string, m *manifest) error {
+	if !isRemote(dir) {
+		return writeManifest(dir, m, r.ManifestCompression)
+	}
+	b, err := marshalManifest(m, r.ManifestCompression)
+	if err != nil {
+		return err
+	}
+	host, dirPath, _ := remoteDst(dir)
+	p := path.Join(dirPath, manifestName)
+	_, err = r.runRemote(ctx, host, "cat > "+shellQuote(p+".tmp")+" && mv "+shellQuote(p+".tmp")+" "+shellQuote(p), bytes.NewReader(b))
+	return err
+}
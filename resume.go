@@ -0,0 +1,165 @@
+package catalog
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A resume file records the plan of a sync so that an interrupted run can
+// carry on with --resume rather than scanning src and planning again. The
+// first line is the plan as JSON, each following line the path of a file
+// which has been copied.
+type plan struct {
+	Time time.Time       `json:"time"`
+	Src  string          `json:"src"`
+	Dst  string          `json:"dst"`
+	Keep []manifestEntry `json:"keep"`
+	Add  []manifestEntry `json:"add"`
+	Sub  []manifestEntry `json:"sub"`
+}
+
+// resumePath returns the resume file of syncing src to dst.
+func (r *runner) resumePath(dst string) (string, error) {
+	h := sha256.New()
+	for _, dir := range append(r.srcRoots(), dst) {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", abs)
+	}
+	return filepath.Join(os.TempDir(), "catalog-resume-"+hex.EncodeToString(h.Sum(nil))[:16]), nil
+}
+
+func fromEntries(es []manifestEntry) []*file {
+	var fs []*file
+	for _, e := range es {
+		fs = append(fs, &file{
+			dir:         filepath.Dir(e.Path),
+			base:        filepath.Base(e.Path),
+			size:        e.Size,
+			modTime:     e.ModTime,
+			captureTime: e.ModTime,
+			from:        e.From,
+		})
+	}
+	return fs
+}
+
+// resumeLog is an open resume file to which copied files are appended.
+type resumeLog struct {
+	f *os.File
+}
+
+// writePlan starts the resume file of d.
+func (r *runner) writePlan(d *destination) (*resumeLog, error) {
+	path, err := r.resumePath(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(&plan{
+		Time: time.Now(),
+		Src:  r.Src,
+		Dst:  d.dir,
+		Keep: toEntries(d.keep),
+		Add:  toEntries(d.add),
+		Sub:  toEntries(d.sub),
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%s\n", b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &resumeLog{f}, nil
+}
+
+// done records that path, as printed by rsync -v, has been copied.
+func (l *resumeLog) done(path string) {
+	if _, err := fmt.Fprintln(l.f, path); err != nil {
+		log.Printf("Failed to update %s: %v\n", l.f.Name(), err)
+	}
+}
+
+func (l *resumeLog) Close() error {
+	return l.f.Close()
+}
+
+// readPlan returns the plan in the resume file of dst with the files which
+// have been copied, or nil if there is none.
+func (r *runner) readPlan(dst string) (*plan, map[string]bool, error) {
+	path, err := r.resumePath(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<30)
+	if !s.Scan() {
+		return nil, nil, fmt.Errorf("%s is empty", path)
+	}
+	var p plan
+	if err := json.Unmarshal(s.Bytes(), &p); err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	done := make(map[string]bool)
+	for s.Scan() {
+		done[s.Text()] = true
+	}
+	return &p, done, s.Err()
+}
+
+// clearPlan removes the resume file of dst.
+func (r *runner) clearPlan(dst string) error {
+	path, err := r.resumePath(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// resumeFrom sets up d to carry on with p, skipping the files which have been
+// copied and those which are no longer there to be removed.
+func (d *destination) resumeFrom(p *plan, done map[string]bool) {
+	d.keep = fromEntries(p.Keep)
+	d.used = totalSize(d.keep)
+	for _, f := range fromEntries(p.Add) {
+		if !done[manifestPath(f)] {
+			d.add = append(d.add, f)
+		}
+	}
+	present := make(map[string]bool)
+	for _, f := range d.files {
+		present[f.path()] = true
+	}
+	for _, f := range fromEntries(p.Sub) {
+		if present[f.path()] {
+			d.sub = append(d.sub, f)
+		}
+	}
+	log.Printf("Resuming the run of %s: %d of %d files left to copy, %d to remove\n",
+		p.Time.Format(time.DateTime), len(d.add), len(p.Add), len(d.sub))
+}
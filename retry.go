@@ -0,0 +1,75 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// transient reports whether err, from a file system operation or rsync, may
+// go away when retried, as with a network share having a blip. Anything else,
+// like running out of space or permissions, is fatal.
+func transient(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case 10, // Error in socket I/O.
+			12, // Error in rsync protocol data stream.
+			30, // Timeout in data send/receive.
+			35: // Timeout waiting for daemon connection.
+			return true
+		}
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EIO, syscall.EAGAIN, syscall.ECONNRESET, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry calls op until it succeeds, fails with an error which isn't
+// transient or has been retried --retries times. The first retry comes after
+// --retry-delay, and each next one after twice the previous delay. The retries
+// are counted in d.retries under name.
+func (d *destination) retry(ctx context.Context, name string, op func() error) error {
+	delay := d.RetryDelay
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i == d.Retries || !transient(err) {
+			return err
+		}
+		log.Printf("Retrying %s in %s: %v\n", name, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		d.mu.Lock()
+		if d.retries == nil {
+			d.retries = make(map[string]int)
+		}
+		d.retries[name]++
+		d.mu.Unlock()
+	}
+}
+
+// reportRetries prints how many times the operations on d were retried.
+func (d *destination) reportRetries() {
+	var names []string
+	for name := range d.retries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		n := d.retries[name]
+		report("retries", fmt.Sprintf("retried %s %d times", name, n), "dst", d.dir, "name", name, "retries", n)
+	}
+}
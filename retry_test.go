@@ -0,0 +1,52 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	r := testRunner()
+	r.Retries = 2
+	r.RetryDelay = 0
+	for _, tc := range []struct {
+		name    string
+		errs    []error // returned by the successive calls, then nil
+		calls   int
+		wantErr bool
+	}{
+		{"success", nil, 1, false},
+		{"transient", []error{&os.PathError{Op: "remove", Path: "x", Err: syscall.EIO}}, 2, false},
+		{"too many", []error{syscall.EIO, syscall.EINTR, syscall.EIO}, 3, true},
+		{"fatal", []error{fmt.Errorf("copy: %w", syscall.ENOSPC)}, 1, true},
+		{"permission", []error{os.ErrPermission}, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &destination{runner: r}
+			calls := 0
+			err := d.retry(context.Background(), "x", func() error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("retry() = %v, want error: %v", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, tc.errs[calls-1]) {
+				t.Errorf("retry() = %v, want %v", err, tc.errs[calls-1])
+			}
+			if calls != tc.calls {
+				t.Errorf("%d calls, want %d", calls, tc.calls)
+			}
+			if got, want := d.retries["x"], tc.calls-1; got != want {
+				t.Errorf("%d retries counted, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// move is a file of dst to be renamed to where a file of src is stored, as it
+// has the same content.
+type move struct {
+	f, from *file
+}
+
+// planReuse takes the files of d.add which are already in d.dir under another
+// path off d.add, with --dedupe-across-src-dst. Those about to be removed are
+// moved into place, to d.moves, and those staying are hard linked, to
+// d.links. Only the files of the same size are hashed.
+func (d *destination) planReuse(ctx context.Context) error {
+	adding := make(map[string]bool)
+	for _, f := range d.add {
+		adding[f.path()] = true
+	}
+	removing := make(map[*file]bool)
+	for _, f := range d.sub {
+		removing[f] = true
+	}
+	bySize := make(map[int64][]*file)
+	for _, f := range d.files {
+		// An outdated copy is about to be overwritten.
+		if f.link == "" && !adding[f.path()] {
+			bySize[f.size] = append(bySize[f.size], f)
+		}
+	}
+	hashes := make(map[*file]string)
+	dstHash := func(f *file) (string, error) {
+		if h, ok := hashes[f]; ok {
+			return h, nil
+		}
+		h, err := d.hash(filepath.Join(d.dir, f.path()))
+		if err != nil {
+			return "", err
+		}
+		hashes[f] = h
+		return h, nil
+	}
+	moved := make(map[*file]bool)
+	var add []*file
+	for _, f := range d.add {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var candidates []*file
+		for _, g := range bySize[f.size] {
+			if g.path() != f.path() && !moved[g] {
+				candidates = append(candidates, g)
+			}
+		}
+		if len(candidates) == 0 || f.link != "" {
+			add = append(add, f)
+			continue
+		}
+		h := f.hash
+		if h == "" {
+			var err error
+			if h, err = d.hash(d.srcFile(f.srcPath())); err != nil {
+				return err
+			}
+		}
+		var from, target *file
+		for _, g := range candidates {
+			gh, err := dstHash(g)
+			if err != nil {
+				return err
+			}
+			if gh != h {
+				continue
+			}
+			if removing[g] {
+				from = g
+				break
+			}
+			if target == nil {
+				target = g
+			}
+		}
+		switch {
+		case from != nil:
+			moved[from] = true
+			d.moves = append(d.moves, move{f, from})
+		case target != nil:
+			linked, err := sameFile(filepath.Join(d.dir, f.path()), filepath.Join(d.dir, target.path()))
+			if err != nil {
+				return err
+			}
+			if !linked {
+				d.links = append(d.links, link{f, target})
+			}
+		default:
+			add = append(add, f)
+		}
+	}
+	if len(moved) > 0 {
+		var sub []*file
+		for _, f := range d.sub {
+			if !moved[f] {
+				sub = append(sub, f)
+			}
+		}
+		d.sub = sub
+	}
+	d.add = add
+	return nil
+}
+
+// reuse renames d.moves into place, giving them the mtimes of their src files
+// so that compare sees them as up to date from now on.
+func (d *destination) reuse(ctx context.Context) error {
+	var saved int64
+	for _, m := range d.moves {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(d.dir, m.f.path())
+		from := filepath.Join(d.dir, m.from.path())
+		report("reuse", fmt.Sprintf("moving %s to %s", from, path), "path", path, "from", from, "size", m.f.size, "dry_run", d.DryRun)
+		saved += m.f.size
+		if d.DryRun {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(from, path); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Gone since the scan, so copy it after all.
+				if err := d.copyFile(d.srcFile(m.f.srcPath()), path); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+		if d.preserves("times") {
+			if err := os.Chtimes(path, time.Time{}, m.f.modTime); err != nil {
+				return err
+			}
+		}
+	}
+	if len(d.moves) > 0 {
+		summary("reuse", fmt.Sprintf("Moved %d files (%s) already in %s into place instead of copying them",
+			len(d.moves), d.formatSize(saved), d.dir),
+			"dst", d.dir, "moved", len(d.moves), "saved", saved, "dry_run", d.DryRun)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// srcRoots returns the src directories, Src and then ExtraSrc.
+func (r *runner) srcRoots() []string {
+	return append([]string{r.Src}, r.ExtraSrc...)
+}
+
+// srcLabel returns the directory of dst which the files of the src root are
+// stored under when there are several roots.
+func srcLabel(root string) string {
+	return filepath.Base(root)
+}
+
+// checkRoots returns an error unless the src roots can each have their own
+// directory of dst. Their files can't collide then, whatever their paths.
+func (r *runner) checkRoots() error {
+	if len(r.ExtraSrc) == 0 {
+		return nil
+	}
+	seen := make(map[string]string)
+	for _, root := range r.srcRoots() {
+		label := srcLabel(root)
+		if label == "." || label == ".." || label == string(filepath.Separator) {
+			return fmt.Errorf("--src %s has no name to store its files under in dst", root)
+		}
+		if other, ok := seen[label]; ok {
+			return fmt.Errorf("--src %s and %s have the same name %q, which their files are stored under in dst", other, root, label)
+		}
+		seen[label] = root
+	}
+	return nil
+}
+
+// srcFile returns the file at path in src. With several roots, path starts
+// with the label of its root, as it does in dst.
+func (r *runner) srcFile(path string) string {
+	if len(r.ExtraSrc) > 0 {
+		label, rest, _ := strings.Cut(path, string(filepath.Separator))
+		for _, root := range r.srcRoots() {
+			if srcLabel(root) == label {
+				return filepath.Join(root, rest)
+			}
+		}
+	}
+	return filepath.Join(r.Src, path)
+}
+
+// scanSrc returns the files of src. With several roots, the files of each
+// are put under its label, so that they are stored in a directory of dst
+// named after it.
+func (r *runner) scanSrc(ctx context.Context, opts scanOptions) ([]*file, error) {
+	if len(r.ExtraSrc) == 0 {
+		return r.scanDir(ctx, r.Src, opts)
+	}
+	var files []*file
+	for _, root := range r.srcRoots() {
+		found, err := r.scanDir(ctx, root, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range found {
+			f.dir = filepath.Join(srcLabel(root), f.dir)
+		}
+		files = append(files, found...)
+	}
+	return files, nil
+}
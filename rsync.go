@@ -0,0 +1,180 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rsyncRunner runs rsync. It is execRsync except in tests, which check the
+// arguments and the --files-from list without running anything.
+type rsyncRunner interface {
+	// find fails if there is no rsync at path to run.
+	find(path string) error
+	// run runs the rsync at path with args until it exits or ctx is done,
+	// writing its output to stdout and stderr.
+	run(ctx context.Context, path string, args []string, stdout, stderr io.Writer) error
+}
+
+// execRsync is the rsyncRunner running the rsync command.
+type execRsync struct{}
+
+func (execRsync) find(path string) error {
+	_, err := exec.LookPath(path)
+	return err
+}
+
+func (execRsync) run(ctx context.Context, path string, args []string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	// Give rsync the chance to clean up its partial file.
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			// Windows can't deliver SIGTERM.
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = 10 * time.Second
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// rsyncExitCode returns the exit code of rsync if err is its exit.
+func rsyncExitCode(err error) (int, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+		return 0, false
+	}
+	return exitErr.ExitCode(), true
+}
+
+// vanishedPrefix starts rsync's warning about a src file which is gone by the
+// time it gets to copying it.
+const vanishedPrefix = "file has vanished: "
+
+// stderrScanner passes rsync's stderr through to w while collecting the
+// paths of the files rsync reports as vanished.
+type stderrScanner struct {
+	w        io.Writer
+	buf      []byte
+	vanished []string
+	noSpace  bool // whether rsync ran out of space on dst
+}
+
+func (s *stderrScanner) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	s.buf = append(s.buf, b...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(s.buf[:i]))
+		s.buf = s.buf[i+1:]
+		if p, ok := strings.CutPrefix(line, vanishedPrefix); ok {
+			s.vanished = append(s.vanished, strings.Trim(p, `"`))
+		}
+		if strings.Contains(line, noSpaceMessage) {
+			s.noSpace = true
+		}
+	}
+	return n, err
+}
+
+// rsyncRateUnits are the multipliers of the rates in rsync's progress lines.
+var rsyncRateUnits = map[string]float64{
+	"B/s":  1,
+	"kB/s": 1 << 10,
+	"MB/s": 1 << 20,
+	"GB/s": 1 << 30,
+	"TB/s": 1 << 40,
+}
+
+// parseRsyncRate returns the rate in bytes per second of a progress line of
+// rsync -P, like "  10,485,760 100%   95.24MB/s    0:00:00 (xfr#1, to-chk=0/1)".
+func parseRsyncRate(line string) (float64, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.HasSuffix(fields[1], "%") {
+		return 0, false
+	}
+	s := fields[2]
+	i := strings.IndexFunc(s, func(r rune) bool { return r != '.' && (r < '0' || '9' < r) })
+	if i <= 0 {
+		return 0, false
+	}
+	unit, ok := rsyncRateUnits[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	rate, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	return rate * unit, true
+}
+
+// reportThroughput reports how fast rsync copied the plan of d, the files of
+// pw, in elapsed, along with the peak rate if rsync printed its progress.
+func (d *destination) reportThroughput(pw *progressWriter, elapsed time.Duration) {
+	size := totalSize(d.add)
+	msg := fmt.Sprintf("rsync moved %s to %s in %s (~%s", d.formatSize(size), d.dir, elapsed.Round(time.Second), d.rate(size, elapsed))
+	if pw.peak > 0 {
+		msg += fmt.Sprintf(", peak %s/s", d.formatSize(int64(pw.peak)))
+	}
+	report("throughput", msg+")", "dst", d.dir, "bytes", size, "duration", elapsed, "peak_rate", int64(pw.peak))
+}
+
+// acceptExit returns nil if err is an rsync exit with one of
+// --rsync-ok-codes, warning about it, or err otherwise.
+func (d *destination) acceptExit(err error) error {
+	code, ok := rsyncExitCode(err)
+	if !ok || !slices.Contains(d.RsyncOKCodes, code) {
+		return err
+	}
+	log.Printf("rsync to %s exited with code %d, carrying on\n", d.dir, code)
+	return nil
+}
+
+// rsyncOutOfSpace is outOfSpace for rsync, which pw saw the output of. The
+// file rsync was on when it failed is the one it printed last, and those it
+// didn't start on are still pending.
+func (d *destination) rsyncOutOfSpace(pw *progressWriter, err error) {
+	d.outOfSpace(func(f *file) bool {
+		_, pending := pw.pending[f.path()]
+		return !pending && f.path() != pw.last
+	}, pw.last, err)
+	// Not to be marked as done.
+	pw.last = ""
+}
+
+// dropVanished takes the src files rsync reported as vanished out of d.add and
+// d.keep, which are what the verification and the manifest go by.
+func (d *destination) dropVanished(vanished []string) {
+	if len(vanished) == 0 {
+		return
+	}
+	gone := make(map[string]bool)
+	for _, p := range vanished {
+		// rsync names them by their paths under src.
+		if rel, err := filepath.Rel(d.Src, p); err == nil && !strings.HasPrefix(rel, "..") {
+			p = rel
+		}
+		gone[filepath.Clean(p)] = true
+		report("vanished", fmt.Sprintf("vanished from src: %s", p), "path", p, "dst", d.dir)
+	}
+	isGone := func(f *file) bool { return gone[f.path()] }
+	d.add = slices.DeleteFunc(d.add, isGone)
+	d.keep = slices.DeleteFunc(d.keep, isGone)
+	log.Printf("%d files vanished from src while copying to %s\n", len(vanished), d.dir)
+}
@@ -0,0 +1,82 @@
+package catalog
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// units returns files, which are in the order of mostRecent, as the units
+// selected as a whole. Those are the files sharing a name but for the
+// extension in a directory of src with --group-sidecars, like IMG_0001.CR2,
+// IMG_0001.JPG and IMG_0001.xmp, and single files otherwise. A unit comes
+// where its first file does, its newest one unless --sort-by=size.
+func (r *runner) units(files []*file) [][]*file {
+	if !r.GroupSidecars {
+		return units1(files)
+	}
+	var units [][]*file
+	index := make(map[string]int)
+	grouped := 0
+	for _, f := range files {
+		p := f.srcPath()
+		name := strings.TrimSuffix(p, filepath.Ext(p))
+		if i, ok := index[name]; ok {
+			if len(units[i]) == 1 {
+				grouped++
+			}
+			units[i] = append(units[i], f)
+			continue
+		}
+		index[name] = len(units)
+		units = append(units, []*file{f})
+	}
+	log.Printf("Grouping sidecars: %d files in %d units, %d of them with several files\n", len(files), len(units), grouped)
+	return units
+}
+
+// units1 returns files as units of one file each.
+func units1(files []*file) [][]*file {
+	units := make([][]*file, len(files))
+	for i, f := range files {
+		units[i] = []*file{f}
+	}
+	return units
+}
+
+// concat returns the files of units.
+func concat(units [][]*file) []*file {
+	var files []*file
+	for _, u := range units {
+		files = append(files, u...)
+	}
+	return files
+}
+
+// reportGrouping prints how --group-sidecars changed the selection: the
+// files kept which wouldn't have been on their own, as they came with newer
+// ones, and the files left out which would have, as the rest of their units
+// didn't fit.
+func (r *runner) reportGrouping(grouped, alone []*file) {
+	in := func(files []*file) map[*file]bool {
+		m := make(map[*file]bool)
+		for _, f := range files {
+			m[f] = true
+		}
+		return m
+	}
+	inGrouped, inAlone := in(grouped), in(alone)
+	var gained, lost []*file
+	for _, f := range grouped {
+		if !inAlone[f] {
+			gained = append(gained, f)
+		}
+	}
+	for _, f := range alone {
+		if !inGrouped[f] {
+			lost = append(lost, f)
+		}
+	}
+	log.Printf("Grouping sidecars kept %d files (%s) which wouldn't have been on their own and left out %d (%s) which would have\n",
+		len(gained), r.formatSize(totalSize(gained)), len(lost), r.formatSize(totalSize(lost)))
+}
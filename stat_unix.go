@@ -0,0 +1,45 @@
+//go:build unix
+
+package catalog
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// createPerm is the mode os.Create gives new files, 0666 less the umask,
+// which can only be read by setting it.
+var createPerm = func() fs.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return 0666 &^ fs.FileMode(mask)
+}()
+
+// fileID returns the device and inode numbers identifying the file at path.
+func fileID(path string) (dev, ino uint64, ok bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
+
+// fileOwner returns the owning user and group of fi.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// isNoSpace reports whether err is the file system running out of space.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
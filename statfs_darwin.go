@@ -0,0 +1,82 @@
+package catalog
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// stat returns the capacity of the storage corresponding to dir.
+func stat(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// avail returns the space available to us on the storage corresponding to dir,
+// excluding the blocks reserved for root.
+func avail(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// blockSize returns the block size of the file system of dir, in units of
+// which files take up space.
+func blockSize(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bsize), nil
+}
+
+// isFAT reports whether dir is on a FAT file system, which stores mtimes with
+// a 2 second resolution.
+func isFAT(dir string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return unix.ByteSliceToString(stat.Fstypename[:]) == "msdos"
+}
+
+// foldsCase reports whether dir is on a file system which ignores the case of
+// names, FAT or exFAT. APFS and HFS+ volumes may too, but only the photo frame
+// ones are detected.
+func foldsCase(dir string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	switch unix.ByteSliceToString(stat.Fstypename[:]) {
+	case "msdos", "exfat":
+		return true
+	}
+	return false
+}
+
+// fileTimes returns the access and modification times of fi.
+func fileTimes(fi fs.FileInfo) (atime, mtime time.Time, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(st.Atimespec.Unix()), time.Unix(st.Mtimespec.Unix()), true
+}
+
+// fsType returns the name of the type of the file system of dir, e.g. apfs
+// or msdos.
+func fsType(dir string) (string, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(stat.Fstypename[:]), nil
+}
@@ -0,0 +1,137 @@
+package catalog
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// stat returns the capacity of the storage corresponding to dir.
+func stat(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Blocks) * stat.Bsize, nil
+}
+
+// avail returns the space available to us on the storage corresponding to dir.
+// Note that this is Bavail and not Bfree: Bfree also counts the blocks
+// reserved for root (5% by default on ext4), which a non-root rsync can't
+// write to.
+func avail(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
+
+// blockSize returns the block size of the file system of dir, in units of
+// which files take up space.
+func blockSize(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bsize, nil
+}
+
+// isFAT reports whether dir is on a FAT file system, which stores mtimes with
+// a 2 second resolution.
+func isFAT(dir string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Type == unix.MSDOS_SUPER_MAGIC
+}
+
+// foldsCase reports whether dir is on a file system which ignores the case of
+// names, FAT or exFAT.
+func foldsCase(dir string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Type == unix.MSDOS_SUPER_MAGIC || stat.Type == unix.EXFAT_SUPER_MAGIC
+}
+
+// fileTimes returns the access and modification times of fi.
+func fileTimes(fi fs.FileInfo) (atime, mtime time.Time, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix()), true
+}
+
+// fsType returns the name of the type of the file system of dir as mount(8)
+// has it, e.g. ext4 or vfat, from the mount with the longest mount point
+// containing dir.
+func fsType(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var best, typ string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// ID, parent ID, major:minor, root, mount point, options, optional
+		// fields, "-", type, source, super options.
+		fields := strings.Fields(s.Text())
+		sep := slices.Index(fields, "-")
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		mnt := unescapeMount(fields[4])
+		if rel, err := filepath.Rel(mnt, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		// Later mounts over the same point hide the earlier ones.
+		if len(mnt) >= len(best) {
+			best, typ = mnt, fields[sep+1]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	if typ == "" {
+		return "", fmt.Errorf("no mount of %s in /proc/self/mountinfo", dir)
+	}
+	return typ, nil
+}
+
+// unescapeMount undoes the octal escapes of spaces and the like in the paths
+// of /proc/self/mountinfo.
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
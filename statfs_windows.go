@@ -0,0 +1,151 @@
+package catalog
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// diskFreeSpace returns the total and the available to us bytes of the volume
+// corresponding to dir.
+func diskFreeSpace(dir string) (total, avail int64, err error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var availToCaller, totalBytes, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &availToCaller, &totalBytes, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return int64(totalBytes), int64(availToCaller), nil
+}
+
+// stat returns the capacity of the storage corresponding to dir.
+func stat(dir string) (int64, error) {
+	total, _, err := diskFreeSpace(dir)
+	return total, err
+}
+
+// avail returns the space available to us on the storage corresponding to dir,
+// which takes quotas into account.
+func avail(dir string) (int64, error) {
+	_, avail, err := diskFreeSpace(dir)
+	return avail, err
+}
+
+var procGetDiskFreeSpace = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetDiskFreeSpaceW")
+
+// blockSize returns the cluster size of the volume of dir, in units of which
+// files take up space.
+func blockSize(dir string) (int64, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	p, err := windows.UTF16PtrFromString(abs)
+	if err != nil {
+		return 0, err
+	}
+	vol := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p, &vol[0], uint32(len(vol))); err != nil {
+		return 0, err
+	}
+	var sectorsPerCluster, bytesPerSector, freeClusters, clusters uint32
+	if r, _, err := procGetDiskFreeSpace.Call(uintptr(unsafe.Pointer(&vol[0])),
+		uintptr(unsafe.Pointer(&sectorsPerCluster)), uintptr(unsafe.Pointer(&bytesPerSector)),
+		uintptr(unsafe.Pointer(&freeClusters)), uintptr(unsafe.Pointer(&clusters))); r == 0 {
+		return 0, err
+	}
+	return int64(sectorsPerCluster) * int64(bytesPerSector), nil
+}
+
+// isFAT reports whether dir is on a FAT file system, which stores mtimes with
+// a 2 second resolution.
+func isFAT(dir string) bool {
+	name, err := fsType(dir)
+	// FAT, FAT32 or exFAT.
+	return err == nil && strings.HasSuffix(name, "FAT")
+}
+
+// fsType returns the name of the type of the file system of dir, e.g. NTFS
+// or exFAT.
+func fsType(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	p, err := windows.UTF16PtrFromString(abs)
+	if err != nil {
+		return "", err
+	}
+	vol := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p, &vol[0], uint32(len(vol))); err != nil {
+		return "", err
+	}
+	name := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumeInformation(&vol[0], nil, 0, nil, nil, nil, &name[0], uint32(len(name))); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(name), nil
+}
+
+// foldsCase reports whether dir is on a file system which ignores the case of
+// names, which is all of them on Windows.
+func foldsCase(dir string) bool {
+	return true
+}
+
+// fileTimes returns the access and modification times of fi. The access time
+// is zero, which os.Chtimes leaves alone, if it isn't available.
+func fileTimes(fi fs.FileInfo) (atime, mtime time.Time, ok bool) {
+	if d, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		atime = time.Unix(0, d.LastAccessTime.Nanoseconds())
+	}
+	return atime, fi.ModTime(), true
+}
+
+// fileID returns the volume serial and file index identifying the file at
+// path.
+func fileID(path string) (dev, ino uint64, ok bool) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	// FILE_FLAG_BACKUP_SEMANTICS is needed to open directories.
+	h, err := windows.CreateFile(p, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer windows.CloseHandle(h)
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+		return 0, 0, false
+	}
+	return uint64(info.VolumeSerialNumber), uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), true
+}
+
+// createPerm is the mode os.Create gives new files, of which Windows only
+// keeps the write bit.
+const createPerm fs.FileMode = 0666
+
+// fileOwner always fails as Windows has no numeric owners to preserve.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// isNoSpace reports whether err is the file system running out of space.
+func isNoSpace(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
+
+// copyXattrs is never called on Windows, where --xattrs is refused.
+func (r *runner) copyXattrs(srcPath, dstPath string) error {
+	return errors.ErrUnsupported
+}
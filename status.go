@@ -0,0 +1,106 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// status is how far a run got, for the status printed on Config.Status.
+type status struct {
+	mu    sync.Mutex // guards the following and the totals of runner.summary
+	start time.Time
+	phase string
+	since time.Time // when phase started
+	dst   *destination
+	pw    *progressWriter // of the copy to dst, once it started
+}
+
+// setPhase records that the run is on to the phase name.
+func (r *runner) setPhase(name string) {
+	r.status.mu.Lock()
+	defer r.status.mu.Unlock()
+	r.status.phase, r.status.since = name, time.Now()
+}
+
+// setSyncing records that the run is on to syncing d, or done with syncing if
+// d is nil.
+func (r *runner) setSyncing(d *destination) {
+	r.status.mu.Lock()
+	defer r.status.mu.Unlock()
+	r.status.dst, r.status.pw = d, nil
+}
+
+// setCopying records that the copy to the destination being synced is
+// printing to pw.
+func (r *runner) setCopying(pw *progressWriter) {
+	r.status.mu.Lock()
+	defer r.status.mu.Unlock()
+	r.status.pw = pw
+}
+
+// watchStatus prints the status whenever Config.Status receives until the
+// returned function is called.
+func (r *runner) watchStatus() (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-r.Status:
+				r.printStatus()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// printStatus prints the phase the run is in, how far the destination being
+// synced got and the totals of those done, to stderr.
+func (r *runner) printStatus() {
+	s := &r.status
+	s.mu.Lock()
+	phase, since, d, pw := s.phase, s.since, s.dst, s.pw
+	elapsed := time.Since(s.start)
+	added, bytes, removed := r.summary.Added, r.summary.Bytes, r.summary.Removed
+	s.mu.Unlock()
+	if phase == "" {
+		phase = "setup"
+	}
+	parts := []string{fmt.Sprintf("%s for %s, %s into the run", phase, time.Since(since).Round(time.Second), elapsed.Round(time.Second))}
+	attrs := []any{"phase", phase, "elapsed", elapsed}
+	if d != nil {
+		d.mu.Lock()
+		dremoved := d.removed
+		d.mu.Unlock()
+		parts = append(parts, fmt.Sprintf("%s: removed %d of %d files", d.dir, dremoved, len(d.sub)))
+		attrs = append(attrs, "dst", d.dir, "dst_removed", dremoved, "dst_to_remove", len(d.sub))
+		if pw != nil {
+			pw.mu.Lock()
+			files, copied := pw.files, pw.bytes
+			pw.mu.Unlock()
+			parts = append(parts, fmt.Sprintf("copied %d/%d files, %s/%s", files, pw.total, r.formatSize(copied), r.formatSize(pw.size)))
+			attrs = append(attrs, "dst_copied", files, "dst_to_copy", pw.total, "dst_bytes", copied, "dst_total_bytes", pw.size)
+			if left, ok := pw.remaining(); ok {
+				parts = append(parts, "eta "+formatRemaining(left))
+				attrs = append(attrs, "remaining", left)
+			}
+		}
+	}
+	parts = append(parts, fmt.Sprintf("done so far: added %d files (%s), removed %d files", added, r.formatSize(bytes), removed))
+	attrs = append(attrs, "added", added, "bytes", bytes, "removed", removed)
+	if r.jsonLogs() {
+		report("status", strings.Join(parts, "; "), attrs...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "status: %s\n", strings.Join(parts, "; "))
+}
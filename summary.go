@@ -0,0 +1,59 @@
+package catalog
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// summaryRecord is what --summary-json holds, a Summary along with how the
+// run ended.
+type summaryRecord struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	DryRun   bool  `json:"dry_run"`
+	LinkOnly bool  `json:"link_only"`
+	Added    int   `json:"added"`
+	Bytes    int64 `json:"bytes"`
+	Removed  int   `json:"removed"`
+	Skipped  int   `json:"skipped"`
+	Pruned   int   `json:"pruned"`
+	// Left out when everything fits.
+	Cutoff          *time.Time `json:"cutoff,omitempty"`
+	NewestSkipped   *time.Time `json:"newest_skipped,omitempty"`
+	VerifyFailed    []string   `json:"verify_failed"`
+	Errors          []string   `json:"errors"`
+	DurationSeconds float64    `json:"duration_seconds"`
+}
+
+// writeSummary writes s and runErr, what Run returns, to path as JSON. It is
+// replaced atomically so that readers never see half of it.
+func writeSummary(path string, s Summary, dryRun bool, runErr error) error {
+	rec := summaryRecord{
+		OK:              runErr == nil,
+		DryRun:          dryRun,
+		LinkOnly:        s.LinkOnly,
+		Added:           s.Added,
+		Bytes:           s.Bytes,
+		Removed:         s.Removed,
+		Skipped:         s.Skipped,
+		Pruned:          s.Pruned,
+		VerifyFailed:    s.VerifyFailed,
+		Errors:          s.Errors,
+		DurationSeconds: s.Duration.Seconds(),
+	}
+	if runErr != nil {
+		rec.Error = runErr.Error()
+	}
+	if !s.Cutoff.IsZero() {
+		rec.Cutoff = &s.Cutoff
+	}
+	if !s.NewestSkipped.IsZero() {
+		rec.NewestSkipped = &s.NewestSkipped
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(b, '\n'), 0644)
+}
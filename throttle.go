@@ -0,0 +1,64 @@
+package catalog
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter throttles the bytes passed through it to a rate in bytes per
+// second. It's shared by all the writers throttled with it, limiting their
+// aggregate throughput.
+type limiter struct {
+	rate int64
+
+	mu    sync.Mutex
+	start time.Time
+	n     int64 // bytes since start
+}
+
+// wait blocks until passing n more bytes keeps l within its rate.
+func (l *limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+	// Don't let idle time accumulate into a burst.
+	if now.Sub(due) > time.Second {
+		l.start, l.n, due = now, 0, now
+	}
+	l.n += int64(n)
+	l.mu.Unlock()
+	time.Sleep(time.Until(due))
+}
+
+// throttledWriter is an io.Writer limited by a limiter.
+type throttledWriter struct {
+	w io.Writer
+	l *limiter
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	// Small chunks keep the throughput smooth.
+	chunk := int(max(t.l.rate/10, 1))
+	for len(b) > 0 {
+		c := b[:min(len(b), chunk)]
+		t.l.wait(len(c))
+		n, err := t.w.Write(c)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttle returns w limited by --bwlimit, which applies to all the copies of
+// the run together.
+func (r *runner) throttle(w io.Writer) io.Writer {
+	if r.bandwidth == nil {
+		return w
+	}
+	return &throttledWriter{w, r.bandwidth}
+}
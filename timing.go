@@ -0,0 +1,65 @@
+package catalog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// phases is how long each phase of a run took with --timing, summed over the
+// destinations, in the order they first came up.
+type phases struct {
+	mu    sync.Mutex
+	names []string
+	spent map[string]time.Duration
+}
+
+// phase starts timing the phase name, returning the function which ends it.
+// It is also the phase of the status.
+func (r *runner) phase(name string) (end func()) {
+	r.setPhase(name)
+	if !r.Timing {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		p := &r.timings
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.spent == nil {
+			p.spent = make(map[string]time.Duration)
+		}
+		if _, ok := p.spent[name]; !ok {
+			p.names = append(p.names, name)
+		}
+		p.spent[name] += time.Since(start)
+	}
+}
+
+// reportTiming prints the time spent in each phase of the run, which took
+// total, and in anything else.
+func (r *runner) reportTiming(total time.Duration) {
+	pct := func(d time.Duration) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total)
+	}
+	// To the millisecond, except for what is shorter, which a small run is
+	// all about.
+	round := func(d time.Duration) time.Duration {
+		if d < time.Millisecond {
+			return d.Round(time.Microsecond)
+		}
+		return d.Round(time.Millisecond)
+	}
+	other := total
+	for _, name := range r.timings.names {
+		d := r.timings.spent[name]
+		other -= d
+		summary("timing", fmt.Sprintf("%s: %s (%.0f%%)", name, round(d), pct(d)),
+			"phase", name, "duration", d, "pct", pct(d))
+	}
+	summary("timing", fmt.Sprintf("other: %s (%.0f%%), total %s", round(other), pct(other), round(total)),
+		"phase", "other", "duration", other, "pct", pct(other), "total", total)
+}
@@ -0,0 +1,108 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// transcodes reports whether f is to be transcoded with --transcode rather
+// than copied, by its extension.
+func (r *runner) transcodes(f *file) bool {
+	if r.Transcode == "" {
+		return false
+	}
+	ext := strings.TrimPrefix(filepath.Ext(f.base), ".")
+	for _, e := range r.TranscodeExt {
+		if strings.EqualFold(ext, strings.TrimPrefix(e, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// estimateTranscoded sets the sizes of the files to transcode to what they
+// take up on dst, so that the budget is spent on the smaller versions. That
+// is the size of the version on one of dests if it is up to date, and
+// --transcode-ratio of the original size until there is one.
+func (r *runner) estimateTranscoded(files []*file, dests []*destination) {
+	stored := make(map[string]*file)
+	fat := make(map[*file]bool)
+	for _, d := range dests {
+		for _, f := range d.files {
+			if _, ok := stored[f.path()]; !ok {
+				stored[f.path()] = f
+				fat[f] = d.fat
+			}
+		}
+	}
+	var n int
+	var before, after int64
+	for _, f := range files {
+		if !r.transcodes(f) {
+			continue
+		}
+		n++
+		before += f.size
+		if g, ok := stored[f.path()]; ok && f.modTime.Sub(g.modTime) <= r.tolerance(fat[g]) {
+			f.size = g.size
+		} else {
+			f.size = int64(float64(f.size) * r.TranscodeRatio)
+		}
+		after += f.size
+	}
+	if n > 0 {
+		log.Printf("Counting %d files to transcode (%s) as %s\n", n, r.formatSize(before), r.formatSize(after))
+	}
+}
+
+// transcode writes the version of srcPath made by --transcode to dstPath,
+// creating the parent directories as needed and preserving the attributes
+// selected by --preserve. Like copyFile, it replaces dstPath once the command
+// succeeded. srcPath is only read.
+func (d *destination) transcode(ctx context.Context, srcPath, dstPath string) (err error) {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	// The command may tell the format to write by the extension.
+	out, err := os.CreateTemp(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".*.tmp"+filepath.Ext(dstPath))
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	out.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if err := d.runHook(ctx, "transcode", d.Transcode, "CATALOG_INPUT="+srcPath, "CATALOG_OUTPUT="+tmp); err != nil {
+		return err
+	}
+	ti, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if ti.Size() == 0 {
+		return fmt.Errorf("transcode %q wrote nothing for %s", d.Transcode, srcPath)
+	}
+	if err := os.Chmod(tmp, createPerm); err != nil {
+		return err
+	}
+	if err := d.preserveAttrs(fi, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dstPath); err != nil {
+		return err
+	}
+	report("transcode", fmt.Sprintf("transcoded %s from %s to %s", dstPath, d.formatSize(fi.Size()), d.formatSize(ti.Size())),
+		"path", dstPath, "src_size", fi.Size(), "size", ti.Size())
+	return nil
+}
@@ -0,0 +1,129 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// trashing reports whether removed files go to the trash rather than being
+// deleted.
+func (r *runner) trashing() bool {
+	return r.DeletePolicy == "trash" || r.TrashDir != ""
+}
+
+// keeping reports whether dst files which weren't selected stay, with
+// --delete-policy=keep or --no-delete.
+func (r *runner) keeping() bool {
+	return r.DeletePolicy == "keep" || r.NoDelete
+}
+
+// trashOf returns the trash of the destination dir: --trash-dir if set, or
+// trashName in dir.
+func (r *runner) trashOf(dir string) string {
+	if r.TrashDir != "" {
+		return r.TrashDir
+	}
+	return filepath.Join(dir, trashName)
+}
+
+// moveToTrash moves path to trashPath, copying and deleting it if the trash
+// is on another file system. The file gets the time it was trashed as its
+// mtime, for rotateTrash.
+func (r *runner) moveToTrash(path, trashPath string) error {
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(path, trashPath)
+	if errors.Is(err, syscall.EXDEV) {
+		if err := r.copyFile(path, trashPath); err != nil {
+			return err
+		}
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(trashPath, now, now)
+}
+
+// rotateTrash deletes the files in the trash dir with the oldest mtimes, so
+// those trashed first, until it is within --trash-max.
+func (r *runner) rotateTrash(dir string) error {
+	if r.TrashMax == 0 {
+		return nil
+	}
+	type trashed struct {
+		path string
+		fi   fs.FileInfo
+	}
+	var files []trashed
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, trashed{path, fi})
+		size += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if size <= r.TrashMax {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].fi.ModTime().Before(files[j].fi.ModTime())
+	})
+	var evicted []string
+	for _, t := range files {
+		if size <= r.TrashMax {
+			break
+		}
+		report("evict", fmt.Sprintf("evicting %s", t.path), "path", t.path, "size", t.fi.Size())
+		if err := os.Remove(t.path); err != nil {
+			return err
+		}
+		size -= t.fi.Size()
+		evicted = append(evicted, t.path)
+	}
+	log.Printf("Evicted %d files from %s, leaving %s\n", len(evicted), dir, r.formatSize(size))
+	return r.removeEmptyParents(dir, evicted)
+}
+
+// onSameDevice reports whether dir and path, or the closest of its parents
+// which exists, are on the same file system. It assumes so if that's unknown.
+func onSameDevice(dir, path string) bool {
+	dev, _, ok := fileID(dir)
+	if !ok {
+		return true
+	}
+	for {
+		if d, _, ok := fileID(path); ok {
+			return d == dev
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return true
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,99 @@
+//go:build unix
+
+package catalog
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrsUnsupported reports whether err is from a file system without
+// extended attributes, such as FAT, exFAT or some network ones.
+func xattrsUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// copyXattrs gives dstPath the extended attributes of srcPath with --xattrs,
+// which on macOS hold the Finder tags and color labels. A dst which can't
+// store them is warned about once and otherwise left alone.
+func (r *runner) copyXattrs(srcPath, dstPath string) error {
+	names, err := listXattrs(srcPath)
+	if err != nil {
+		if xattrsUnsupported(err) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(srcPath, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Setxattr(dstPath, name, value, 0); err != nil {
+			if xattrsUnsupported(err) {
+				r.xattrWarning.Do(func() {
+					log.Printf("%s doesn't support extended attributes (%v), skipping them\n", filepath.Dir(dstPath), err)
+				})
+				return nil
+			}
+			// Those of the trusted and security namespaces are only for root.
+			if errors.Is(err, syscall.EPERM) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of path.
+func listXattrs(path string) ([]string, error) {
+	b, err := readXattr(func(dest []byte) (int, error) { return unix.Listxattr(path, dest) })
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for len(b) > 0 {
+		i := 0
+		for i < len(b) && b[i] != 0 {
+			i++
+		}
+		if i > 0 {
+			names = append(names, string(b[:i]))
+		}
+		b = b[min(i+1, len(b)):]
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path, name string) ([]byte, error) {
+	return readXattr(func(dest []byte) (int, error) { return unix.Getxattr(path, name, dest) })
+}
+
+// readXattr calls read with a buffer large enough for what it returns,
+// asking for the size first, and again if it grew in between.
+func readXattr(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		b := make([]byte, n)
+		n, err = read(b)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyXattrs(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.jpg"), filepath.Join(dir, "dst", "dst.jpg")
+	if err := os.WriteFile(src, []byte("photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(src, "user.catalog.tag", []byte("red"), 0); err != nil {
+		t.Skipf("no extended attributes on %s: %v", dir, err)
+	}
+	r := testRunner()
+	r.Xattrs = true
+	if err := r.copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := getXattr(dst, "user.catalog.tag"); err != nil || string(got) != "red" {
+		t.Errorf("user.catalog.tag of the copy = %q, %v, want red", got, err)
+	}
+	if got := r.rsyncArgs("list", "dst"); !slices.Contains(got, "--xattrs") {
+		t.Errorf("rsyncArgs() = %q, want --xattrs in it", got)
+	}
+}